@@ -1,22 +1,56 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/profiles/latest/keyvault/keyvault"
-	kvauth "github.com/Azure/azure-sdk-for-go/services/keyvault/auth"
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
+	azauth "github.com/Azure/go-autorest/autorest/azure/auth"
+	"golang.org/x/crypto/pkcs12"
 
 	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"sigs.k8s.io/kustomize/api/ifc"
 	"sigs.k8s.io/kustomize/api/kv"
 	"sigs.k8s.io/kustomize/api/resmap"
@@ -28,420 +62,3413 @@ const azureTenantID = "AZURE_TENANT_ID"
 const azureClientID = "AZURE_CLIENT_ID"
 const azureClientSecret = "AZURE_CLIENT_SECRET"
 const azureAuthLocation = "AZURE_AUTH_LOCATION"
+const azureFederatedTokenFile = "AZURE_FEDERATED_TOKEN_FILE"
+const azureAuthorityHost = "AZURE_AUTHORITY_HOST"
+const azureClientCertificatePath = "AZURE_CLIENT_CERTIFICATE_PATH"
+const azureClientCertificatePassword = "AZURE_CLIENT_CERTIFICATE_PASSWORD"
+const azureEnvironment = "AZURE_ENVIRONMENT"
+const azureKeyVaultResource = "AZURE_KEYVAULT_RESOURCE"
 const disableAzureAuthValidation = "DISABLE_AZURE_AUTH_VALIDATION"
 const offlineTestingMode = "AZURE_SECRETS_OFFLINE_TESTING_MODE"
 const warnForSeconds = "AZURE_SECRETS_OFFLINE_TESTING_MODE_WARN_SECONDS"
+const offlineTestingSeed = "AZURE_SECRETS_OFFLINE_TESTING_SEED"
+const offlineRefuseInCI = "AZURE_SECRETS_OFFLINE_TESTING_REFUSE_IN_CI"
+const environmentEnv = "AZURE_SECRETS_ENVIRONMENT"
+const fixturesEnv = "AZURE_SECRETS_FIXTURES"
+const fixturesScheme = "file://"
+const cassetteEnv = "AZURE_SECRETS_CASSETTE"
+const cassetteModeEnv = "AZURE_SECRETS_CASSETTE_MODE"
+const cassetteKeyEnv = "AZURE_SECRETS_CASSETTE_KEY"
+const lockModeEnv = "AZURE_SECRETS_LOCK_MODE"
+const logLevelEnv = "AZURE_SECRETS_LOG_LEVEL"
+const logFormatEnv = "AZURE_SECRETS_LOG_FORMAT"
+const testVaultName = "__TESTING_AZURESECRETS__"
+
+const formatJSON = "json"
+const formatYAML = "yaml"
+const formatDotenv = "dotenv"
+const formatProperties = "properties"
+
+const secretTypeOpaque = "Opaque"
+const secretTypeTLS = "kubernetes.io/tls"
+const secretTypeDockerConfigJSON = "kubernetes.io/dockerconfigjson"
+const secretTypeServiceAccountToken = "kubernetes.io/service-account-token"
+const serviceAccountNameAnnotation = "kubernetes.io/service-account.name"
+
+// offlineAnnotation is added to everything generated from made up secrets so that they can't be deployed by mistake
+const offlineAnnotation = "azure-secrets/offline"
+
+// requiredKeys are the keys that secrets of the other built in types must have, at least one key from each group is
+// required
+var requiredKeys = map[string][][]string{
+	"kubernetes.io/basic-auth":      {{"username", "password"}},
+	"kubernetes.io/ssh-auth":        {{"ssh-privatekey"}},
+	"kubernetes.io/dockercfg":       {{".dockercfg"}},
+	"bootstrap.kubernetes.io/token": {{"token-id"}, {"token-secret"}},
+}
+
+const lockModeLocked = "locked"
+const lockModeUpdate = "update"
+
+const cassetteModeRecord = "record"
+const cassetteModeReplay = "replay"
+
+const cassetteValuesRedacted = "redacted"
+const cassetteValuesEncrypted = "encrypted"
+const cassetteValuesPlain = "plain"
+
+const authTypeEnvironment = "environment"
+const authTypeFile = "file"
+const authTypeManagedIdentity = "managedIdentity"
+const authTypeWorkloadIdentity = "workloadIdentity"
+const authTypeClientCertificate = "clientCertificate"
+const authTypeAzureCli = "azureCli"
+
+var clouds = map[string]azure.Environment{
+	"public": azure.PublicCloud,
+	"china":  azure.ChinaCloud,
+	"usgov":  azure.USGovernmentCloud,
+	"german": azure.GermanCloud,
+}
 
 type innerSecret struct {
-	Name              string   `json:"name,omitempty" yaml:"name,omitempty"`
-	Namespace         string   `json:"namespace,omitempty" yaml:"namespace,omitempty"`
-	Keys              []string `json:"keys,omitempty" yaml:"keys,omitempty"`
-	Base64Decode      bool     `json:"base64decode,omitempty" yaml:"base64decode,omitempty"`
-	OutputAsConfigMap bool     `json:"outputAsConfigMap,omitempty" yaml:"outputAsConfigMap,omitempty"`
-	Errored           bool
-	Options           *types.GeneratorOptions
+	Name              string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Namespace         string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Vault             string            `json:"vault,omitempty" yaml:"vault,omitempty"`
+	Keys              []string          `json:"keys,omitempty" yaml:"keys,omitempty"`
+	Base64Decode      bool              `json:"base64decode,omitempty" yaml:"base64decode,omitempty"`
+	Transforms        []string          `json:"transforms,omitempty" yaml:"transforms,omitempty"`
+	OutputAsConfigMap bool              `json:"outputAsConfigMap,omitempty" yaml:"outputAsConfigMap,omitempty"`
+	Type              string            `json:"type,omitempty" yaml:"type,omitempty"`
+	Certificate       string            `json:"certificate,omitempty" yaml:"certificate,omitempty"`
+	Expand            string            `json:"expand,omitempty" yaml:"expand,omitempty"`
+	Format            string            `json:"format,omitempty" yaml:"format,omitempty"`
+	Prefix            string            `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Include           []string          `json:"include,omitempty" yaml:"include,omitempty"`
+	Exclude           []string          `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	Templates         map[string]string `json:"templates,omitempty" yaml:"templates,omitempty"`
+	OnError           *errorOptions     `json:"onError,omitempty" yaml:"onError,omitempty"`
+	// Errored is set when one of the vault secrets that this secret uses could not be read
+	Errored bool `json:"-" yaml:"-"`
+	// Labels, annotations and disableNameSuffixHash for this secret
+	types.GeneratorOptions `json:",inline" yaml:",inline"`
 }
 
 type plugin struct {
 	pluginHelper     *resmap.PluginHelpers
 	types.ObjectMeta `json:"metadata,omitempty" yaml:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
 	Vault            string        `json:"vault,omitempty" yaml:"vault,omitempty"`
+	VaultURL         string        `json:"vaultURL,omitempty" yaml:"vaultURL,omitempty"`
+	Cloud            string        `json:"cloud,omitempty" yaml:"cloud,omitempty"`
 	Secrets          []innerSecret `json:"secrets,omitempty" yaml:"secrets,omitempty"`
 	Verbose          bool          `json:"verbose,omitempty" yaml:"verbose,omitempty"`
+	LogLevel         string        `json:"logLevel,omitempty" yaml:"logLevel,omitempty"`
+	LogFormat        string        `json:"logFormat,omitempty" yaml:"logFormat,omitempty"`
 	OnError          errorOptions  `json:"onError,omitempty" yaml:"onError,omitempty"`
-	async            bool          // This doesn't work
+	LockFile         string        `json:"lockFile,omitempty" yaml:"lockFile,omitempty"`
+	LockMode         string        `json:"lockMode,omitempty" yaml:"lockMode,omitempty"`
+	CacheFile        string        `json:"cacheFile,omitempty" yaml:"cacheFile,omitempty"`
+	OfflineSeed      string        `json:"offlineSeed,omitempty" yaml:"offlineSeed,omitempty"`
+	Cassette         string        `json:"cassette,omitempty" yaml:"cassette,omitempty"`
+	CassetteMode     string        `json:"cassetteMode,omitempty" yaml:"cassetteMode,omitempty"`
+	CassetteValues   string        `json:"cassetteValues,omitempty" yaml:"cassetteValues,omitempty"`
+	ForbidOfflineFor []string      `json:"forbidOfflineFor,omitempty" yaml:"forbidOfflineFor,omitempty"`
+	Strict           bool          `json:"strict,omitempty" yaml:"strict,omitempty"`
+	Parallelism      int           `json:"parallelism,omitempty" yaml:"parallelism,omitempty"`
+	Retry            retryPolicy   `json:"retry,omitempty" yaml:"retry,omitempty"`
+	Auth             authOptions   `json:"auth,omitempty" yaml:"auth,omitempty"`
 	factory          *resmap.Factory
 	loader           ifc.KvLoader
+	lock             *secretLock
+	cache            *placeholderCache
+	cassette         *cassette
+	forbidOffline    []offlinePolicy
+	clients          map[string]iKvClient
+	authorizer       autorest.Authorizer
+	redactor         *redactor
+	log              *logger
 }
 
 type errorOptions struct {
 	Warn          bool                   `json:"warn,omitempty" yaml:"warn,omitempty"`
 	Exclude       bool                   `json:"exclude,omitempty" yaml:"exclude,omitempty"`
 	PatchMetadata types.GeneratorOptions `json:"patchMetadata,omitempty" yaml:"patchMetadata,omitempty"`
+	Placeholder   placeholderOptions     `json:"placeholder,omitempty" yaml:"placeholder,omitempty"`
 }
 
-type secretValue struct {
-	name  string
-	value string
-	err   error
+func (o errorOptions) validate(cacheFile string) error {
+	ph := o.Placeholder
+	switch ph.strategy() {
+	case placeholderRandom, placeholderFail:
+	case placeholderPrevious:
+		if cacheFile == "" {
+			return errors.Errorf("The %s placeholder strategy requires cacheFile to be set", placeholderPrevious)
+		}
+	case placeholderSentinel:
+		if ph.Value == "" {
+			return errors.Errorf("The %s placeholder strategy requires a value", placeholderSentinel)
+		}
+	default:
+		return errors.Errorf("Invalid placeholder strategy '%s', expected %s, %s, %s or %s", ph.Strategy, placeholderRandom, placeholderPrevious, placeholderSentinel, placeholderFail)
+	}
+	if ph.Length < 0 {
+		return errors.Errorf("Invalid placeholder length %d, expected a positive number", ph.Length)
+	}
+	return nil
 }
 
-var KustomizePlugin plugin
+const placeholderRandom = "random"
+const placeholderPrevious = "previous"
+const placeholderSentinel = "sentinel"
+const placeholderFail = "fail"
 
-func (p *plugin) Config(ph *resmap.PluginHelpers, c []byte) (err error) {
-	p.debug("Azure Secrets - config start")
-	p.Namespace = "default"
-	p.OnError = errorOptions{
-		Warn:          false,
-		PatchMetadata: types.GeneratorOptions{},
+// placeholderPrefix starts every random placeholder so that they are easy to find
+const placeholderPrefix = "ERROR_"
+
+// placeholderMarker stands in for the values of vault secrets that could not be read until placeholderContents
+// replaces the contents of the secrets that use them
+const placeholderMarker = placeholderPrefix + "PLACEHOLDER"
+const defaultPlaceholderLength = 32
+const defaultPlaceholderCharset = "1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// placeholderOptions controls the values that are given to the keys of a secret that could not be read. Random
+// placeholders are the default, previous uses the values from the last successful build and sentinel uses fixed values.
+type placeholderOptions struct {
+	Strategy string            `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+	Length   int               `json:"length,omitempty" yaml:"length,omitempty"`
+	Charset  string            `json:"charset,omitempty" yaml:"charset,omitempty"`
+	Value    string            `json:"value,omitempty" yaml:"value,omitempty"`
+	Values   map[string]string `json:"values,omitempty" yaml:"values,omitempty"`
+}
+
+func (o placeholderOptions) strategy() string {
+	if o.Strategy == "" {
+		return placeholderRandom
 	}
-	p.pluginHelper = ph
-	p.factory = ph.ResmapFactory()
-	p.loader = kv.NewLoader(p.pluginHelper.Loader(), p.pluginHelper.Validator())
-	err = yaml.Unmarshal(c, p)
-	p.debug("Azure Secrets - config end")
-	return err
+	return o.Strategy
 }
 
-func (p *plugin) Generate() (resmap.ResMap, error) {
-	p.debug("Azure Secrets - generate start")
-	var outerResmap resmap.ResMap
-	_, err := getKvClient(p.Vault)
-	if err != nil {
-		p.debug("Azure Secrets - generate error")
-		return nil, err
+// random returns a new random placeholder. We add some random characters to the end of the value in case it is being
+// used to define something like a password, we don't want someone to be able to force a system in to a state where an
+// important password becomes "ERROR".
+func (o placeholderOptions) random() (string, error) {
+	length, charset := o.Length, o.Charset
+	if length == 0 {
+		length = defaultPlaceholderLength
 	}
-	var options *types.GeneratorOptions
-	options = nil
-	var secretValues map[string]string
-	if p.async {
-		secretValues, err = p.getSecretValuesAsync()
-	} else {
-		secretValues, err = p.getSecretValues()
+	if charset == "" {
+		charset = defaultPlaceholderCharset
 	}
+	chars, err := randomString(length, charset)
 	if err != nil {
-		p.debug("Azure Secrets - generate error %v", err)
-
-		if err != nil {
-			p.debug("Azure Secrets - generate error")
-			outerResmap, secretValues, options, err = p.handleError(err)
-			if err != nil {
-				return nil, err
-			}
-			if outerResmap != nil {
-				return outerResmap, nil
-			}
-		}
+		return "", err
 	}
+	return placeholderPrefix + chars, nil
+}
 
-	outerResmap = resmap.New()
-	for _, sec := range p.Secrets {
-		var innerResmap resmap.ResMap
-		var err error
-		if sec.OutputAsConfigMap {
-			innerResmap, err = p.outputAsConfigMap(sec, secretValues, options)
-		} else {
-			innerResmap, err = p.generateSecret(sec, secretValues, options)
-		}
-		if err != nil {
-			p.debug("Azure Secrets - generate error")
-			return nil, err
-		}
-		outerResmap.AppendAll(innerResmap)
+// authOptions controls how the plugin authenticates with Azure, unset values are read from the usual Azure SDK
+// environment variables
+type authOptions struct {
+	Type             string `json:"type,omitempty" yaml:"type,omitempty"`
+	TenantID         string `json:"tenantId,omitempty" yaml:"tenantId,omitempty"`
+	ClientID         string `json:"clientId,omitempty" yaml:"clientId,omitempty"`
+	TokenFile        string `json:"tokenFile,omitempty" yaml:"tokenFile,omitempty"`
+	CertificatePath  string `json:"certificatePath,omitempty" yaml:"certificatePath,omitempty"`
+	AuthorityHost    string `json:"authorityHost,omitempty" yaml:"authorityHost,omitempty"`
+	IdentityEndpoint string `json:"identityEndpoint,omitempty" yaml:"identityEndpoint,omitempty"`
+	AzCommand        string `json:"azCommand,omitempty" yaml:"azCommand,omitempty"`
+}
+
+func (a authOptions) validate() error {
+	switch a.Type {
+	case "", authTypeEnvironment, authTypeFile, authTypeManagedIdentity, authTypeWorkloadIdentity, authTypeClientCertificate, authTypeAzureCli:
+		return nil
 	}
-	p.debug("Azure Secrets - generate end")
-	return outerResmap, nil
+	return errors.Errorf("Invalid auth type '%s', expected one of %s, %s, %s, %s, %s or %s", a.Type, authTypeEnvironment, authTypeFile, authTypeManagedIdentity, authTypeWorkloadIdentity, authTypeClientCertificate, authTypeAzureCli)
+}
+
+func (a authOptions) tenantID() string {
+	return valueOrEnv(a.TenantID, azureTenantID)
 }
 
-func (p *plugin) handleError(err error) (resmap.ResMap, map[string]string, *types.GeneratorOptions, error) {
-	yml, _ := yaml.Marshal(p)
-	if !p.OnError.Warn {
-		return nil, nil, nil, errors.Wrapf(err, "Error generating %s %s", yml, p.Name)
+func (a authOptions) clientID() string {
+	return valueOrEnv(a.ClientID, azureClientID)
+}
+
+func (a authOptions) oauthConfig(env azure.Environment) (*adal.OAuthConfig, error) {
+	authorityHost := valueOrEnv(a.AuthorityHost, azureAuthorityHost)
+	if authorityHost == "" {
+		authorityHost = env.ActiveDirectoryEndpoint
 	}
-	fmt.Fprintf(os.Stderr, "AZURESECERTS WARNING: Error '%s' generating secret %s\n", err.Error(), p.Name)
-	if p.OnError.Exclude {
-		return resmap.New(), nil, nil, nil
+	if a.tenantID() == "" {
+		return nil, errors.Errorf("A tenant ID is required, set auth.tenantId or %s", azureTenantID)
 	}
-	secNames := p.getUniqueSecretNames()
-	secValues := make(map[string]string, len(secNames))
-	for i := 0; i < len(secNames); i++ {
-		// We add some random character to the end of the value in case it being use to define something like a password
-		// We don't want someone to be able to force a system in to a state where an important password becomes "ERROR"
-		secValues[secNames[i]] = base64.StdEncoding.EncodeToString([]byte("ERROR_" + string(getRandomChars(32))))
+	if a.clientID() == "" {
+		return nil, errors.Errorf("A client ID is required, set auth.clientId or %s", azureClientID)
 	}
-	return nil, secValues, &p.OnError.PatchMetadata, nil
+	return adal.NewOAuthConfig(authorityHost, a.tenantID())
 }
 
-func getSecret(valuesChan chan secretValue, name string, vaultName string) {
-	fmt.Fprintf(os.Stderr, "Getting secret '%s' in vault %v\n", name, vaultName)
-	kvClient, err := getKvClient(vaultName)
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Fprintf(os.Stderr, "%v", err)
-			valuesChan <- secretValue{name, "", errors.Errorf("%v", err)}
-		}
-	}()
-	sec, err := kvClient.getSecret(name)
-	if err != nil {
-		valuesChan <- secretValue{name, "", err}
+func valueOrEnv(value string, env string) string {
+	if value != "" {
+		return value
 	}
-	valuesChan <- secretValue{name, *sec, nil}
+	return os.Getenv(env)
+}
+
+// federatedTokenSecret authenticates with the federated token that workload identity writes to a file. The file is
+// read every time a token is requested because it is rotated.
+type federatedTokenSecret struct {
+	tokenFile string
 }
 
-func (p *plugin) getSecretValues() (map[string]string, error) {
-	kvClient, err := getKvClient(p.Vault)
+func (s *federatedTokenSecret) SetAuthenticationValues(_ *adal.ServicePrincipalToken, v *url.Values) error {
+	token, err := ioutil.ReadFile(s.tokenFile)
 	if err != nil {
-		p.debug("Error getting client %v", err)
-		return nil, errors.Wrapf(err, "Error getting client")
+		return errors.Wrapf(err, "Error reading federated token file %s", s.tokenFile)
 	}
-	secNames := p.getUniqueSecretNames()
-	values := make(map[string]string)
+	v.Set("client_assertion", strings.TrimSpace(string(token)))
+	v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	return nil
+}
 
-	for _, n := range secNames {
-		p.debug("Getting value for %s", n)
-		sec, err := kvClient.getSecret(n)
-		if err != nil {
-			p.debug("Error getting secret %s %v", n, err)
-			return nil, err
-		}
-		values[n] = *sec
-	}
-	return values, nil
+func (s federatedTokenSecret) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("Marshalling federated token secrets is not supported")
 }
 
-func (p *plugin) getSecretValuesAsync() (map[string]string, error) {
-	p.debug("Get Secret Values Start")
-	values := make(map[string]string)
-	valuesChan := make(chan secretValue)
-	secNames := p.getUniqueSecretNames()
+// refreshableToken is a token that the authorizer refreshes before each request if it is about to expire
+type refreshableToken interface {
+	adal.OAuthTokenProvider
+	adal.RefresherWithContext
+}
 
-	for _, n := range secNames {
-		p.debug("Getting value for %s", n)
-		go getSecret(valuesChan, n, p.Vault)
-	}
-	for range secNames {
-		val := <-valuesChan
-		if val.err != nil {
-			p.debug("Error from channel %v", val.err)
-			close(valuesChan)
-			return nil, errors.Wrapf(val.err, "Error getting secret %s", val.name)
-		}
-		p.debug("Got %s for %s", val.name, val.value)
-		values[val.name] = val.value
-	}
-	return values, nil
+// azureCliToken gets tokens by running az account get-access-token, the Azure CLI must already be logged in
+type azureCliToken struct {
+	command  string
+	resource string
+	tenantID string
+	mutex    sync.Mutex
+	token    string
+	expires  time.Time
 }
 
-func (p *plugin) getUniqueSecretNames() []string {
-	var keys []string
-	for _, s := range p.Secrets {
-		for _, key := range s.Keys {
-			kv := strings.Split(key, "=")
-			if !contains(keys, kv[1]) {
-				keys = append(keys, kv[1])
-			}
-		}
-	}
-	sort.Strings(keys)
-	return keys
+func (t *azureCliToken) OAuthToken() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.token
 }
 
-func contains(arr []string, str string) bool {
-	for _, a := range arr {
-		if a == str {
-			return true
-		}
+func (t *azureCliToken) EnsureFreshWithContext(ctx context.Context) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.token != "" && time.Until(t.expires) > 5*time.Minute {
+		return nil
 	}
-	return false
+	return t.refresh(ctx)
 }
 
-func (p *plugin) generateSecret(secret innerSecret, values map[string]string, options *types.GeneratorOptions) (resmap.ResMap, error) {
-	name, namespace, contents, err := p.generateContents(secret, values)
-	if err != nil {
-		return nil, err
+func (t *azureCliToken) RefreshWithContext(ctx context.Context) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.refresh(ctx)
+}
+
+func (t *azureCliToken) RefreshExchangeWithContext(ctx context.Context, resource string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.resource = resource
+	return t.refresh(ctx)
+}
+
+func (t *azureCliToken) refresh(ctx context.Context) error {
+	args := []string{"account", "get-access-token", "--resource", t.resource, "--output", "json"}
+	if t.tenantID != "" {
+		args = append(args, "--tenant", t.tenantID)
 	}
-	args := types.SecretArgs{}
-	args.Name = name
-	args.Namespace = namespace
-	args.LiteralSources = contents
-	return p.factory.FromSecretArgs(p.loader, options, args)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "Error running '%s %s': %s", t.command, strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	res := struct {
+		AccessToken string `json:"accessToken"`
+		ExpiresOn   string `json:"expiresOn"`
+		ExpiresOnTS int64  `json:"expires_on"`
+	}{}
+	if err := json.Unmarshal(stdout.Bytes(), &res); err != nil || res.AccessToken == "" {
+		return errors.Errorf("Could not read an access token from the output of '%s %s'", t.command, strings.Join(args, " "))
+	}
+	t.token = res.AccessToken
+	if res.ExpiresOnTS != 0 {
+		t.expires = time.Unix(res.ExpiresOnTS, 0)
+	} else if expires, err := time.ParseInLocation("2006-01-02 15:04:05.999999", res.ExpiresOn, time.Local); err == nil {
+		// Older versions of the CLI only return the expiry in local time
+		t.expires = expires
+	} else {
+		t.expires = time.Now()
+	}
+	return nil
 }
 
-func (p *plugin) outputAsConfigMap(secret innerSecret, values map[string]string, options *types.GeneratorOptions) (resmap.ResMap, error) {
-	name, namespace, contents, err := p.generateContents(secret, values)
+// readCertificate reads a client certificate and its RSA private key from a PEM or PFX file
+func readCertificate(certPath string, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(certPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, errors.Wrapf(err, "Error reading certificate %s", certPath)
 	}
-	args := types.ConfigMapArgs{}
-	args.Name = name
-	args.Namespace = namespace
-	args.LiteralSources = contents
-	return p.factory.FromConfigMapArgs(p.loader, options, args)
+	var cert *x509.Certificate
+	var key interface{}
+	if block, _ := pem.Decode(data); block == nil {
+		key, cert, err = pkcs12.Decode(data, password)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Error decoding PFX certificate %s", certPath)
+		}
+	} else {
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			switch {
+			case block.Type == "CERTIFICATE" && cert == nil:
+				cert, err = x509.ParseCertificate(block.Bytes)
+			case block.Type == "RSA PRIVATE KEY":
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			case block.Type == "PRIVATE KEY":
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			}
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Error decoding %s in %s", block.Type, certPath)
+			}
+		}
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if cert == nil || !ok {
+		return nil, nil, errors.Errorf("%s must contain a certificate and an RSA private key", certPath)
+	}
+	return cert, rsaKey, nil
 }
 
-func (p *plugin) generateContents(secret innerSecret, values map[string]string) (string, string, []string, error) {
-	name := secret.Name
-	namespace := secret.Namespace
-	var contents []string
+// retryPolicy controls how reads that fail with a transient error are retried
+type retryPolicy struct {
+	MaxAttempts          int             `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+	BaseDelay            metav1.Duration `json:"baseDelay,omitempty" yaml:"baseDelay,omitempty"`
+	MaxDelay             metav1.Duration `json:"maxDelay,omitempty" yaml:"maxDelay,omitempty"`
+	Jitter               float64         `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	RetryableStatusCodes []int           `json:"retryableStatusCodes,omitempty" yaml:"retryableStatusCodes,omitempty"`
+}
 
-	if name == "" {
-		name = p.Name
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{
+		MaxAttempts: 6,
+		BaseDelay:   metav1.Duration{Duration: 500 * time.Millisecond},
+		MaxDelay:    metav1.Duration{Duration: 30 * time.Second},
+		Jitter:      0.2,
+		// Azure keyvault seems to randomly throw 401s at us which we have to ignore and just try again
+		RetryableStatusCodes: []int{
+			http.StatusUnauthorized,
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
 	}
-	if namespace == "" {
-		namespace = p.Namespace
+}
+
+func (r retryPolicy) validate() error {
+	if r.MaxAttempts < 1 {
+		return errors.Errorf("Invalid retry maxAttempts %d, expected at least 1", r.MaxAttempts)
 	}
-	if name == "" {
-		return "", "", nil, errors.Errorf("Secret is missing name: %v", secret)
+	if r.BaseDelay.Duration < 0 || r.MaxDelay.Duration < r.BaseDelay.Duration {
+		return errors.Errorf("Invalid retry delays, expected 0 <= baseDelay (%v) <= maxDelay (%v)", r.BaseDelay.Duration, r.MaxDelay.Duration)
 	}
-	if namespace == "" {
-		return "", "", nil, errors.Errorf("Secret is missing namespace: %v", secret)
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return errors.Errorf("Invalid retry jitter %v, expected a number between 0 and 1", r.Jitter)
 	}
+	return nil
+}
 
-	for _, key := range secret.Keys {
-		kv := strings.Split(key, "=")
-		if len(kv) == 2 {
-			if v, ok := values[kv[1]]; ok {
-				if secret.Base64Decode {
-					data, err := base64.StdEncoding.DecodeString(v)
-					if err != nil {
-						return "", "", nil, errors.Wrapf(err, "Could not base64 decode '%s'", v)
-					}
-					v = string(data)
+// classify returns whether err is transient and worth retrying, along with how long the vault asked us to wait
+func (r retryPolicy) classify(err error) (bool, time.Duration) {
+	if de, ok := errors.Cause(err).(autorest.DetailedError); ok {
+		if code, ok := de.StatusCode.(int); ok && code != autorest.UndefinedStatusCode {
+			for _, c := range r.RetryableStatusCodes {
+				if c == code {
+					return true, retryAfter(de.Response)
 				}
-				contents = append(contents, kv[0]+"="+v)
 			}
+			return false, 0
 		}
+		err = de.Original
 	}
-	return name, namespace, contents, nil
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true, 0
+	}
+	return false, 0
 }
 
-func (p *plugin) debug(format string, a ...interface{}) {
-	if p.Verbose {
-		fmt.Fprintf(os.Stderr, "Azure Secrets - "+format+"\n", a)
+// delay returns how long to wait before the next attempt. Retry-After is honoured up to MaxDelay.
+func (r retryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	// Doubling stops at maxDelay so that large base delays or many attempts can't overflow
+	d := r.BaseDelay.Duration
+	for i := 1; i < attempt && d < r.MaxDelay.Duration; i++ {
+		d *= 2
+	}
+	if d > r.MaxDelay.Duration {
+		d = r.MaxDelay.Duration
+	}
+	d -= time.Duration(rand.Float64() * r.Jitter * float64(d))
+	if retryAfter > d {
+		d = retryAfter
+	}
+	if d > r.MaxDelay.Duration {
+		d = r.MaxDelay.Duration
 	}
+	return d
 }
 
-func getKvClient(vaultName string) (iKvClient, error) {
-	if os.Getenv(offlineTestingMode) != "" {
-		return randomSecretClient{warnedUser: false, vaultName: vaultName}, nil
+// retryAfter parses the Retry-After header which is either a number of seconds or a date
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
 	}
-	// Kustomize plugins don't seem to support DI'ing mocks :(
-	if vaultName == "__TESTING_AZURESECRETS__" {
-		return testClient{}, nil
+	header := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
 	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
 
-	authFile := os.Getenv(azureAuthLocation)
-	if os.Getenv(disableAzureAuthValidation) == "" {
-		if authFile == "" {
-			if os.Getenv(azureTenantID) == "" || os.Getenv(azureClientID) == "" || os.Getenv(azureClientSecret) == "" {
-				return nil, errors.New(fmt.Sprintf("The environment variables: %s, %s, %s should be set. Or set %s to bypass this check.", azureTenantID, azureClientID, azureClientSecret, disableAzureAuthValidation))
-			}
-		} else {
-			if _, err := os.Stat(authFile); os.IsNotExist(err) {
-				return nil, errors.New(fmt.Sprintf("%s does not exist", authFile))
-			}
+// secretLock records the version of each secret that was resolved so that later builds use exactly the same values
+type secretLock struct {
+	Secrets []lockedSecret `json:"secrets" yaml:"secrets"`
+	changed bool
+	mutex   sync.Mutex
+}
+
+type lockedSecret struct {
+	Vault   string `json:"vault" yaml:"vault"`
+	Name    string `json:"name" yaml:"name"`
+	Version string `json:"version" yaml:"version"`
+	// Missing is set when the secret did not exist, so that keys with fallbacks use the same fallback
+	Missing bool `json:"missing,omitempty" yaml:"missing,omitempty"`
+}
+
+func (l *secretLock) get(vault string, name string) (lockedSecret, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, s := range l.Secrets {
+		if s.Vault == vault && s.Name == name {
+			return s, true
 		}
 	}
+	return lockedSecret{}, false
+}
 
-	var authorizer autorest.Authorizer
-	var err error
-	if authFile == "" {
-		authorizer, err = kvauth.NewAuthorizerFromEnvironment()
-		fmt.Fprintf(os.Stderr, "Using env based auth: %s\n", os.Getenv(azureClientID))
-	} else {
-		authorizer, err = kvauth.NewAuthorizerFromFile(azure.PublicCloud.ResourceManagerEndpoint)
-		fmt.Fprintf(os.Stderr, "Using file based auth: %s\n", authFile)
+func (l *secretLock) set(vault string, name string, version string, missing bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.changed = true
+	for i, s := range l.Secrets {
+		if s.Vault == vault && s.Name == name {
+			l.Secrets[i].Version = version
+			l.Secrets[i].Missing = missing
+			return
+		}
 	}
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to create vault authorizer")
+	l.Secrets = append(l.Secrets, lockedSecret{Vault: vault, Name: name, Version: version, Missing: missing})
+}
+
+// placeholderCache holds the contents of the secrets that use the previous placeholder strategy from the last build
+// that could read them, keyed by namespace/name. Values are base64 encoded.
+type placeholderCache struct {
+	Secrets map[string]map[string]string `json:"secrets" yaml:"secrets"`
+	changed bool
+}
+
+func (c *placeholderCache) get(id string) (map[string]string, bool) {
+	encoded, ok := c.Secrets[id]
+	if !ok {
+		return nil, false
+	}
+	values := make(map[string]string, len(encoded))
+	for k, v := range encoded {
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, false
+		}
+		values[k] = string(data)
 	}
+	return values, true
+}
 
-	basicClient := keyvault.New()
-	basicClient.Authorizer = authorizer
-	client := azKvClient{&basicClient, vaultName}
+func (c *placeholderCache) set(id string, contents []string) {
+	encoded := make(map[string]string, len(contents))
+	for _, content := range contents {
+		kv := strings.SplitN(content, "=", 2)
+		encoded[kv[0]] = base64.StdEncoding.EncodeToString([]byte(kv[1]))
+	}
+	if c.Secrets == nil {
+		c.Secrets = map[string]map[string]string{}
+	}
+	previous, ok := c.Secrets[id]
+	changed := !ok || len(previous) != len(encoded)
+	for k, v := range encoded {
+		changed = changed || previous[k] != v
+	}
+	if changed {
+		c.Secrets[id] = encoded
+		c.changed = true
+	}
+}
 
-	return client, nil
+// notFoundError is returned when a secret does not exist in the vault, or in the fixtures file that is standing in for it
+type notFoundError struct {
+	vault    string
+	name     string
+	fixtures string
 }
 
-type iKvClient interface {
-	getSecret(name string) (*string, error)
+func (e notFoundError) Error() string {
+	if e.fixtures != "" {
+		return fmt.Sprintf("Secret '%s' was not found in vault '%s' in the fixtures %s", e.name, e.vault, e.fixtures)
+	}
+	return fmt.Sprintf("Secret '%s' was not found in vault '%s'", e.name, e.vault)
 }
 
-type azKvClient struct {
-	client    *keyvault.BaseClient
-	vaultName string
+// isNotFound returns true if err means that the secret does not exist, rather than it could not be read
+func isNotFound(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case notFoundError:
+		return true
+	case autorest.DetailedError:
+		code, ok := e.StatusCode.(int)
+		return ok && code == http.StatusNotFound
+	}
+	return false
 }
 
-func (kvc azKvClient) getSecret(name string) (*string, error) {
-	done := false
-	attempts := 0
-	var err error
-	var res keyvault.SecretBundle
-	defer func() {
-		if recoveredErr := recover(); err != nil {
-			err = errors.Errorf("Error getting secret '%s' from vault '%s' %v", name, kvc.vaultName, recoveredErr)
-			fmt.Fprintf(os.Stderr, "%v", err)
-		}
-	}()
-	// Azure keyvault seems to randomly throw 401s at us which we have to ignore and just try again
-	for !done {
-		res, err = kvc.client.GetSecret(context.Background(), "https://"+kvc.vaultName+".vault.azure.net", name, "")
-		done = err == nil || attempts > 5
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error %s on attempt %d\n", err.Error(), attempts)
-			if !strings.Contains(err.Error(), "401") {
-				// done = true
+// vaultSecret is a single version of a secret read from the vault
+type vaultSecret struct {
+	value   string
+	version string
+	enabled bool
+}
+
+type secretValue struct {
+	value string
+	err   error
+}
+
+// logFields are extra fields that are written with a log message
+type logFields map[string]interface{}
+
+const (
+	logLevelError = iota
+	logLevelWarn
+	logLevelInfo
+	logLevelDebug
+)
+
+var logLevels = []string{"error", "warn", "info", "debug"}
+
+const logFormatText = "text"
+const logFormatJSON = "json"
+
+// logger writes messages at or above its level to stderr as text or JSON, with secret values redacted. A nil logger
+// writes nothing.
+type logger struct {
+	level    int
+	format   string
+	redactor *redactor
+}
+
+// newLogger creates a logger from the plugin's logLevel and logFormat, which can be overridden with
+// AZURE_SECRETS_LOG_LEVEL and AZURE_SECRETS_LOG_FORMAT. Only warnings and errors are logged by default, verbose
+// is the same as the debug level.
+func newLogger(level string, format string, verbose bool, r *redactor) (*logger, error) {
+	if verbose && level == "" {
+		level = logLevels[logLevelDebug]
+	}
+	if env := os.Getenv(logLevelEnv); env != "" {
+		level = env
+	}
+	if env := os.Getenv(logFormatEnv); env != "" {
+		format = env
+	}
+	l := &logger{level: logLevelWarn, format: logFormatText, redactor: r}
+	if level != "" {
+		l.level = -1
+		for i, name := range logLevels {
+			if strings.EqualFold(level, name) {
+				l.level = i
 			}
 		}
-		attempts++
+		if l.level < 0 {
+			return nil, errors.Errorf("Invalid log level '%s', expected %s", level, strings.Join(logLevels, ", "))
+		}
 	}
-	if err != nil {
-		return nil, errors.Wrapf(err, "Error getting secret '%s' from vault '%s'", name, kvc.vaultName)
+	if format != "" {
+		if format != logFormatText && format != logFormatJSON {
+			return nil, errors.Errorf("Invalid log format '%s', expected %s or %s", format, logFormatText, logFormatJSON)
+		}
+		l.format = format
 	}
-	return res.Value, nil
+	return l, nil
 }
 
-var rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+func (l *logger) error(msg string, fields logFields) { l.write(logLevelError, msg, fields) }
+func (l *logger) warn(msg string, fields logFields)  { l.write(logLevelWarn, msg, fields) }
+func (l *logger) info(msg string, fields logFields)  { l.write(logLevelInfo, msg, fields) }
+func (l *logger) debug(msg string, fields logFields) { l.write(logLevelDebug, msg, fields) }
+
+func (l *logger) write(level int, msg string, fields logFields) {
+	if l == nil || level > l.level {
+		return
+	}
+	values := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		switch v := v.(type) {
+		case error:
+			values[k] = l.redactor.redact(v.Error())
+		case string:
+			values[k] = l.redactor.redact(v)
+		case time.Duration:
+			values[k] = v.String()
+		default:
+			values[k] = v
+		}
+	}
+	msg = l.redactor.redact(msg)
+	if l.format == logFormatJSON {
+		values["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+		values["level"] = logLevels[level]
+		values["msg"] = msg
+		data, _ := json.Marshal(values)
+		fmt.Fprintln(os.Stderr, string(data))
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Azure Secrets - %s %s", strings.ToUpper(logLevels[level]), msg)
+	for _, k := range sortedFieldNames(values) {
+		v := values[k]
+		if str, ok := v.(string); ok && (str == "" || strings.ContainsAny(str, " \"=")) {
+			v = strconv.Quote(str)
+		}
+		fmt.Fprintf(&buf, " %s=%v", k, v)
+	}
+	fmt.Fprintln(os.Stderr, buf.String())
+}
 
-func getRandomChars(count int) []byte {
-	const charset = "1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	var rndBytes = make([]byte, count)
-	for i := range rndBytes {
-		rndBytes[i] = charset[rnd.Intn(len(charset))]
+func sortedFieldNames(values map[string]interface{}) []string {
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
 	}
-	return rndBytes
+	sort.Strings(names)
+	return names
 }
 
-type randomSecretClient struct {
-	warnedUser bool
-	vaultName  string
+// redactor removes secret values from anything that is written to stderr or returned in an error
+type redactor struct {
+	mutex  sync.Mutex
+	values map[string]bool
 }
 
-func (kvc randomSecretClient) warnUser() {
-	if kvc.warnedUser {
+// minRedactedLength is the length of the shortest value that is redacted, replacing shorter values would make
+// messages unreadable without protecting much
+const minRedactedLength = 4
+
+const redacted = "***"
+
+// jsonValuePattern matches the value field of Key Vault responses, which can appear in SDK errors before the value
+// has been read
+var jsonValuePattern = regexp.MustCompile(`"value"\s*:\s*"(?:[^"\\]|\\.)*"`)
+
+// add records a value that must be redacted, along with its base64 encoding
+func (r *redactor) add(value string) {
+	if r == nil || len(value) < minRedactedLength {
 		return
 	}
-	const red = "\033[1;31m"
-	const noColour = "\033[0m"
-	fmt.Fprintf(os.Stderr, "\n%sWarning whilst reading from vault:\n%s%s\n", red, kvc.vaultName, noColour)
-	fmt.Fprintf(os.Stderr, "%s#########################################%s\n", red, noColour)
-	fmt.Fprintf(os.Stderr, "%s#                                       #%s\n", red, noColour)
-	fmt.Fprintf(os.Stderr, "%s#             AZURE SECRETS             #%s\n", red, noColour)
-	fmt.Fprintf(os.Stderr, "%s#       IS IN OFFLINE TESTING MODE      #%s\n", red, noColour)
-	fmt.Fprintf(os.Stderr, "%s#        RETURNING RANDOM STRINGS       #%s\n", red, noColour)
-	fmt.Fprintf(os.Stderr, "%s#        INSTEAD OF REAL SECRETS!       #%s\n", red, noColour)
-	fmt.Fprintf(os.Stderr, "%s#                                       #%s\n", red, noColour)
-	fmt.Fprintf(os.Stderr, "%s#########################################%s\n", red, noColour)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.values == nil {
+		r.values = map[string]bool{}
+	}
+	r.values[value] = true
+	r.values[base64.StdEncoding.EncodeToString([]byte(value))] = true
+}
 
-	secs, err := strconv.Atoi(os.Getenv(warnForSeconds))
-	if err != nil {
-		secs = 5
+// redact replaces every value that has been added, longest first so that a value containing another is removed whole
+func (r *redactor) redact(s string) string {
+	s = jsonValuePattern.ReplaceAllString(s, `"value":"`+redacted+`"`)
+	if r == nil {
+		return s
+	}
+	r.mutex.Lock()
+	values := make([]string, 0, len(r.values))
+	for v := range r.values {
+		values = append(values, v)
 	}
-	time.Sleep(time.Second * time.Duration(secs))
-	kvc.warnedUser = true
+	r.mutex.Unlock()
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	return s
 }
 
-func (kvc randomSecretClient) getSecret(_ string) (*string, error) {
-	kvc.warnUser()
-	secret := base64.StdEncoding.EncodeToString(getRandomChars(32))
-	return &secret, nil
+// error returns err with any values redacted from its message
+func (r *redactor) error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(r.redact(err.Error()))
 }
 
-// Kustomize plugins don't seem to support DI'ing mocks :(
-type testClient struct {
+// secretRef identifies a secret in a vault, an empty version means the latest version
+type secretRef struct {
+	vault   string
+	name    string
+	version string
 }
 
-func (kvc testClient) getSecret(name string) (*string, error) {
-	var val string
+// id returns the name and version of the secret within its vault
+func (r secretRef) id() string {
+	if r.version == "" {
+		return r.name
+	}
+	return r.name + "@" + r.version
+}
+
+func (r secretRef) String() string {
+	return r.vault + "/" + r.id()
+}
+
+// keyMapping maps a key in the generated secret to a vault secret and, optionally, a JSON path within its value and
+// the transforms that are applied to it
+type keyMapping struct {
+	key        string
+	ref        secretRef
+	path       string
+	transforms []string
+	// fallbacks are tried in order when the vault secret does not exist, then the default value is used if there is
+	// one and then optional keys are left out
+	fallbacks    []keyMapping
+	defaultValue *string
+	optional     bool
+}
+
+// parseKey splits a key mapping in the form key[?]=source[??source...][??'default'] where each source is
+// [vault/]vaultSecretName[@version][#path][|transform...]. Secrets without a vault are read from defaultVault.
+func parseKey(key string, defaultVault string) (keyMapping, bool) {
+	kv := strings.SplitN(key, "=", 2)
+	if len(kv) != 2 {
+		return keyMapping{}, false
+	}
+	sources := kv[1]
+	var defaultValue *string
+	if i := strings.Index(sources, "??'"); i >= 0 && len(sources) > i+3 && strings.HasSuffix(sources, "'") {
+		value := sources[i+3 : len(sources)-1]
+		defaultValue = &value
+		sources = sources[:i]
+	}
+	var m keyMapping
+	for i, source := range strings.Split(sources, "??") {
+		if i == 0 {
+			m = parseSource(source, defaultVault)
+		} else {
+			m.fallbacks = append(m.fallbacks, parseSource(source, defaultVault))
+		}
+	}
+	m.key = kv[0]
+	if strings.HasSuffix(m.key, "?") {
+		m.key = strings.TrimSuffix(m.key, "?")
+		m.optional = true
+	}
+	m.defaultValue = defaultValue
+	return m, true
+}
+
+// sources returns the key's vault secret followed by its fallbacks
+func (m keyMapping) sources() []keyMapping {
+	return append([]keyMapping{m}, m.fallbacks...)
+}
+
+// resolve returns the first of the key's sources that was read and its value
+func (m keyMapping) resolve(values map[string]string) (keyMapping, string, bool) {
+	for _, source := range m.sources() {
+		if v, ok := values[source.ref.String()]; ok {
+			source.key = m.key
+			return source, v, true
+		}
+	}
+	return m, "", false
+}
+
+// parseSource parses the [vault/]vaultSecretName[@version][#path][|transform...] part of a key mapping
+func parseSource(value string, defaultVault string) keyMapping {
+	var m keyMapping
+	if i := strings.Index(value, "|"); i >= 0 {
+		m.transforms = strings.Split(value[i+1:], "|")
+		value = value[:i]
+	}
+	if i := strings.Index(value, "#"); i >= 0 {
+		m.path = value[i+1:]
+		value = value[:i]
+	}
+	m.ref = parseRef(value, defaultVault)
+	return m
+}
+
+// parseRef parses a reference to a secret in the form [vault/]vaultSecretName[@version]
+func parseRef(value string, defaultVault string) secretRef {
+	ref := secretRef{vault: defaultVault, name: value}
+	if i := strings.Index(ref.name, "/"); i >= 0 {
+		ref.vault = ref.name[:i]
+		ref.name = ref.name[i+1:]
+	}
+	if i := strings.LastIndex(ref.name, "@"); i >= 0 {
+		ref.version = ref.name[i+1:]
+		ref.name = ref.name[:i]
+	}
+	return ref
+}
+
+// validate checks the type of the secret, secrets with a certificate are kubernetes.io/tls secrets unless another
+// type is set
+func (s *innerSecret) validate() error {
+	if s.Certificate != "" && s.Type == "" {
+		s.Type = secretTypeTLS
+	}
+	if s.Type != "" && s.Type != secretTypeOpaque && s.OutputAsConfigMap {
+		return errors.Errorf("Secret '%s' is type %s and can not be output as a ConfigMap", s.Name, s.Type)
+	}
+	if s.Certificate != "" && s.Type != secretTypeTLS {
+		return errors.Errorf("Secret '%s' has a certificate but is type %s, expected %s", s.Name, s.Type, secretTypeTLS)
+	}
+	if s.Expand == "" && (s.Format != "" || s.Prefix != "" || len(s.Include) > 0 || len(s.Exclude) > 0) {
+		return errors.Errorf("Secret '%s' has format, prefix, include or exclude set but nothing to expand", s.Name)
+	}
+	if s.Expand != "" {
+		if s.Format == "" {
+			s.Format = formatJSON
+		}
+		if s.Format != formatJSON && s.Format != formatYAML && s.Format != formatDotenv && s.Format != formatProperties {
+			return errors.Errorf("Secret '%s' has invalid format '%s', expected %s, %s, %s or %s", s.Name, s.Format, formatJSON, formatYAML, formatDotenv, formatProperties)
+		}
+		for _, pattern := range append(append([]string{}, s.Include...), s.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("Secret '%s' has invalid include or exclude pattern '%s'", s.Name, pattern)
+			}
+		}
+	}
+	if err := validateTransforms(s.Transforms); err != nil {
+		return errors.Wrapf(err, "Secret '%s' has invalid transforms", s.Name)
+	}
+	keys := map[string]bool{}
+	for _, key := range s.Keys {
+		m, _ := parseKey(key, "")
+		for _, source := range m.sources() {
+			if source.ref.name == "" {
+				return errors.Errorf("Secret '%s' is missing a vault secret name for key '%s'", s.Name, m.key)
+			}
+			if source.path != "" {
+				if _, err := parseJSONPath(source.path); err != nil {
+					return errors.Wrapf(err, "Secret '%s' has an invalid path for key '%s'", s.Name, m.key)
+				}
+			}
+			if err := validateTransforms(source.transforms); err != nil {
+				return errors.Wrapf(err, "Secret '%s' has invalid transforms for key '%s'", s.Name, m.key)
+			}
+		}
+		keys[m.key] = true
+	}
+	for k, body := range s.Templates {
+		_, sources, err := parseTemplate(k, body)
+		if err != nil {
+			return errors.Wrapf(err, "Secret '%s' has an invalid template for key '%s'", s.Name, k)
+		}
+		for _, source := range sources {
+			m := parseSource(source, "")
+			if m.path != "" {
+				if _, err := parseJSONPath(m.path); err != nil {
+					return errors.Wrapf(err, "Secret '%s' has an invalid path in the template for key '%s'", s.Name, k)
+				}
+			}
+			if err := validateTransforms(m.transforms); err != nil {
+				return errors.Wrapf(err, "Secret '%s' has invalid transforms in the template for key '%s'", s.Name, k)
+			}
+		}
+		keys[k] = true
+	}
+	switch s.Type {
+	case "", secretTypeOpaque:
+	case secretTypeTLS:
+		if s.Certificate == "" && s.Expand == "" && (!keys["tls.crt"] || !keys["tls.key"]) {
+			return errors.Errorf("Secret '%s' is type %s but does not have a certificate or tls.crt and tls.key keys", s.Name, s.Type)
+		}
+	case secretTypeDockerConfigJSON:
+		if s.Expand != "" {
+			return errors.Errorf("Secret '%s' is type %s and can not expand a vault secret", s.Name, s.Type)
+		}
+		for k := range keys {
+			if k != "registry" && k != "username" && k != "password" && k != "email" {
+				return errors.Errorf("Secret '%s' is type %s and has key '%s', expected registry, username, password or email", s.Name, s.Type, k)
+			}
+		}
+		if !keys["registry"] || !keys["username"] || !keys["password"] {
+			return errors.Errorf("Secret '%s' is type %s and must have registry, username and password keys", s.Name, s.Type)
+		}
+	case secretTypeServiceAccountToken:
+		if s.Annotations[serviceAccountNameAnnotation] == "" {
+			return errors.Errorf("Secret '%s' is type %s and must have the %s annotation", s.Name, s.Type, serviceAccountNameAnnotation)
+		}
+	default:
+		groups, ok := requiredKeys[s.Type]
+		if !ok && strings.HasPrefix(s.Type, "kubernetes.io/") {
+			return errors.Errorf("Secret '%s' has unsupported type '%s'", s.Name, s.Type)
+		}
+		for _, group := range groups {
+			found := false
+			for _, k := range group {
+				found = found || keys[k]
+			}
+			if !found && s.Expand == "" {
+				return errors.Errorf("Secret '%s' is type %s and must have a %s key", s.Name, s.Type, strings.Join(group, " or "))
+			}
+		}
+	}
+	return nil
+}
+
+// generatorOptions returns the labels, annotations and name suffix option of a secret with patch (if any) applied
+// on top
+func (s innerSecret) generatorOptions(patch *types.GeneratorOptions) *types.GeneratorOptions {
+	options := types.GeneratorOptions{DisableNameSuffixHash: s.DisableNameSuffixHash}
+	for _, o := range []*types.GeneratorOptions{&s.GeneratorOptions, patch} {
+		if o == nil {
+			continue
+		}
+		for k, v := range o.Labels {
+			if options.Labels == nil {
+				options.Labels = map[string]string{}
+			}
+			options.Labels[k] = v
+		}
+		for k, v := range o.Annotations {
+			if options.Annotations == nil {
+				options.Annotations = map[string]string{}
+			}
+			options.Annotations[k] = v
+		}
+		options.DisableNameSuffixHash = options.DisableNameSuffixHash || o.DisableNameSuffixHash
+	}
+	return &options
+}
+
+// vaultFor returns the vault that the keys in secret are read from unless they specify their own
+func (p *plugin) vaultFor(secret innerSecret) string {
+	if secret.Vault != "" {
+		return secret.Vault
+	}
+	return p.Vault
+}
+
+var KustomizePlugin plugin
+
+func (p *plugin) Config(ph *resmap.PluginHelpers, c []byte) (err error) {
+	// Kustomize reuses the same plugin instance so we have to clear out the previous config
+	*p = plugin{}
+	p.Namespace = "default"
+	p.OnError = errorOptions{
+		Warn:          false,
+		PatchMetadata: types.GeneratorOptions{},
+	}
+	p.Retry = defaultRetryPolicy()
+	p.redactor = &redactor{}
+	p.pluginHelper = ph
+	p.factory = ph.ResmapFactory()
+	p.loader = kv.NewLoader(p.pluginHelper.Loader(), p.pluginHelper.Validator())
+	err = yaml.Unmarshal(c, p)
+	if err != nil {
+		return err
+	}
+	p.log, err = newLogger(p.LogLevel, p.LogFormat, p.Verbose, p.redactor)
+	if err != nil {
+		return err
+	}
+	if _, ok := clouds[p.Cloud]; p.Cloud != "" && !ok {
+		return errors.Errorf("Invalid cloud '%s', expected public, china, usgov or german", p.Cloud)
+	}
+	if err := p.Auth.validate(); err != nil {
+		return err
+	}
+	if err := p.Retry.validate(); err != nil {
+		return err
+	}
+	if p.Parallelism < 0 {
+		return errors.Errorf("Invalid parallelism %d, expected a positive number", p.Parallelism)
+	}
+	if mode := p.lockMode(); mode != lockModeLocked && mode != lockModeUpdate {
+		return errors.Errorf("Invalid lockMode '%s', expected '%s' or '%s'", mode, lockModeLocked, lockModeUpdate)
+	}
+	if mode := p.cassetteMode(); mode != cassetteModeRecord && mode != cassetteModeReplay {
+		return errors.Errorf("Invalid cassetteMode '%s', expected '%s' or '%s'", mode, cassetteModeRecord, cassetteModeReplay)
+	}
+	if v := p.cassetteValues(); v != cassetteValuesRedacted && v != cassetteValuesEncrypted && v != cassetteValuesPlain {
+		return errors.Errorf("Invalid cassetteValues '%s', expected '%s', '%s' or '%s'", v, cassetteValuesRedacted, cassetteValuesEncrypted, cassetteValuesPlain)
+	}
+	if err := p.OnError.validate(p.CacheFile); err != nil {
+		return err
+	}
+	for _, entry := range p.ForbidOfflineFor {
+		policy, err := parseOfflinePolicy(entry)
+		if err != nil {
+			return err
+		}
+		p.forbidOffline = append(p.forbidOffline, policy)
+	}
+	for i := range p.Secrets {
+		if err := p.Secrets[i].validate(); err != nil {
+			return err
+		}
+		if p.Secrets[i].OnError != nil {
+			if err := p.Secrets[i].OnError.validate(p.CacheFile); err != nil {
+				return errors.Wrapf(err, "Secret '%s' has invalid onError", p.Secrets[i].Name)
+			}
+		}
+	}
+	p.log.debug("Configured", logFields{"generator": p.Name, "secrets": len(p.Secrets)})
+	return nil
+}
+
+func (p *plugin) Generate() (_ resmap.ResMap, err error) {
+	start := time.Now()
+	defer func() {
+		err = p.redactor.error(err)
+		if err != nil {
+			p.log.debug("Error generating secrets", logFields{"generator": p.Name, "error": err})
+		}
+	}()
+	p.log.debug("Generating secrets", logFields{"generator": p.Name})
+	var outerResmap resmap.ResMap
+	p.clients = make(map[string]iKvClient)
+	err = p.loadCassette()
+	if err != nil {
+		return nil, err
+	}
+	for _, vault := range p.getUniqueVaults() {
+		_, err := p.getClient(vault)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, sec := range p.Secrets {
+		if err := p.checkOfflinePolicy(sec); err != nil {
+			return nil, err
+		}
+	}
+	err = p.loadLock()
+	if err != nil {
+		return nil, err
+	}
+	err = p.loadCache()
+	if err != nil {
+		return nil, err
+	}
+	secretValues, readErrors, err := p.getSecretValues()
+	if cassetteErr := p.saveCassette(); cassetteErr != nil {
+		return nil, cassetteErr
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error generating secrets for %s", p.Name)
+	}
+	errored := false
+	for _, sec := range p.Secrets {
+		errored = errored || p.secretError(sec, secretValues, readErrors) != nil
+	}
+	if !errored {
+		err = p.saveLock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	outerResmap = resmap.New()
+	for _, sec := range p.Secrets {
+		values := secretValues
+		var options *types.GeneratorOptions
+		if err := p.secretError(sec, secretValues, readErrors); err != nil {
+			var exclude bool
+			values, options, exclude, err = p.handleError(&sec, err)
+			if err != nil {
+				return nil, err
+			}
+			if exclude {
+				continue
+			}
+		}
+		if p.isOfflineSecret(sec) {
+			options = withAnnotation(options, offlineAnnotation, "true")
+		}
+		var innerResmap resmap.ResMap
+		var err error
+		if sec.OutputAsConfigMap {
+			innerResmap, err = p.outputAsConfigMap(sec, values, options)
+		} else {
+			innerResmap, err = p.generateSecret(sec, values, options)
+		}
+		if err != nil {
+			return nil, err
+		}
+		outerResmap.AppendAll(innerResmap)
+	}
+	err = p.saveCache()
+	if err != nil {
+		return nil, err
+	}
+	p.log.info("Generated secrets", logFields{"generator": p.Name, "secrets": len(p.Secrets), "duration": time.Since(start)})
+	return outerResmap, nil
+}
+
+// withAnnotation returns a copy of options with an extra annotation
+func withAnnotation(options *types.GeneratorOptions, key string, value string) *types.GeneratorOptions {
+	result := types.GeneratorOptions{Annotations: map[string]string{key: value}}
+	if options == nil {
+		return &result
+	}
+	result.Labels = options.Labels
+	result.DisableNameSuffixHash = options.DisableNameSuffixHash
+	for k, v := range options.Annotations {
+		if k != key {
+			result.Annotations[k] = v
+		}
+	}
+	return &result
+}
+
+// onErrorFor returns the error options of a secret, which are the generator's unless the secret has its own
+func (p *plugin) onErrorFor(secret innerSecret) errorOptions {
+	if secret.OnError != nil {
+		return *secret.OnError
+	}
+	return p.OnError
+}
+
+// secretError returns the first error (in name order) reading the vault secrets that secret uses. Secrets that do not
+// exist are not errors for keys that have a fallback that does, a default value or are optional.
+func (p *plugin) secretError(secret innerSecret, values map[string]string, readErrors map[string]error) error {
+	errs := map[string]error{}
+	noKeys := secret
+	noKeys.Keys = nil
+	for _, ref := range p.secretRefs(noKeys) {
+		if err, ok := readErrors[ref.String()]; ok {
+			errs[ref.String()] = err
+		}
+	}
+	for _, key := range secret.Keys {
+		if m, ok := parseKey(key, p.vaultFor(secret)); ok {
+			if ref, err := m.sourceError(values, readErrors); err != nil {
+				errs[ref.String()] = err
+			}
+		}
+	}
+	if names := sortedErrorNames(errs); len(names) > 0 {
+		return errs[names[0]]
+	}
+	return nil
+}
+
+func sortedErrorNames(errs map[string]error) []string {
+	names := make([]string, 0, len(errs))
+	for k := range errs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sourceError returns the error that stops a key from having a value. Sources that do not exist are only an error
+// when none of them exist and the key has no default value and is not optional, the last one is reported.
+func (m keyMapping) sourceError(values map[string]string, readErrors map[string]error) (secretRef, error) {
+	var ref secretRef
+	var err error
+	for _, source := range m.sources() {
+		if _, ok := values[source.ref.String()]; ok {
+			return secretRef{}, nil
+		}
+		var failed bool
+		if err, failed = readErrors[source.ref.String()]; !failed {
+			return secretRef{}, nil
+		}
+		if ref = source.ref; !isNotFound(err) {
+			return ref, err
+		}
+	}
+	if m.defaultValue != nil || m.optional {
+		return secretRef{}, nil
+	}
+	return ref, err
+}
+
+// handleError applies a secret's onError options when one of its vault secrets could not be read. It either fails,
+// excludes the secret or marks it as errored and returns placeholder values and the metadata to patch it with.
+func (p *plugin) handleError(secret *innerSecret, err error) (map[string]string, *types.GeneratorOptions, bool, error) {
+	onError := p.onErrorFor(*secret)
+	if !onError.Warn {
+		return nil, nil, false, errors.Wrapf(err, "Error generating secrets for %s", p.Name)
+	}
+	fields := logFields{"generator": p.Name, "secret": secret.Name, "error": err}
+	if onError.Exclude {
+		p.log.warn("Error generating secret, excluding it", fields)
+		return nil, nil, true, nil
+	}
+	if onError.Placeholder.strategy() == placeholderFail {
+		return nil, nil, false, errors.Wrapf(err, "Error generating secrets for %s", p.Name)
+	}
+	if p.isStrict() {
+		return nil, nil, false, errors.Wrapf(err, "Error generating secrets for %s, secret '%s' would be output with placeholders which is not allowed in strict mode", p.Name, secret.Name)
+	}
+	p.log.warn("Error generating secret, replacing its values with placeholders", fields)
+	secret.Errored = true
+	refs := p.secretRefs(*secret)
+	values := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		values[ref.String()] = placeholderMarker
+	}
+	return values, &onError.PatchMetadata, false, nil
+}
+
+// placeholderContents replaces the contents of an errored secret using its placeholder strategy. The previous
+// strategy uses every key from the last build that could read the secret and random placeholders for any new keys.
+func (p *plugin) placeholderContents(secret innerSecret, id string, contents []string) ([]string, error) {
+	ph := p.onErrorFor(secret).Placeholder
+	values := map[string]string{}
+	if ph.strategy() == placeholderPrevious {
+		previous, ok := p.cache.get(id)
+		if !ok {
+			p.log.warn("No previous values in the placeholder cache, using random placeholders", logFields{"secret": id})
+		}
+		for k, v := range previous {
+			values[k] = v
+		}
+	}
+	for _, content := range contents {
+		k := content[:strings.Index(content, "=")]
+		if _, ok := values[k]; ok {
+			continue
+		}
+		if ph.strategy() == placeholderSentinel {
+			values[k] = ph.Value
+			if v, ok := ph.Values[k]; ok {
+				values[k] = v
+			}
+			continue
+		}
+		placeholder, err := ph.random()
+		if err != nil {
+			return nil, err
+		}
+		values[k] = placeholder
+	}
+	placeholders := make([]string, 0, len(values))
+	for _, k := range sortedKeys(values) {
+		placeholders = append(placeholders, k+"="+values[k])
+	}
+	return placeholders, nil
+}
+
+// getClient returns the client for a vault, creating it the first time that the vault is used
+func (p *plugin) getClient(vault string) (iKvClient, error) {
+	if kvClient, ok := p.clients[vault]; ok {
+		return kvClient, nil
+	}
+	kvClient, err := p.getKvClient(vault)
+	if err != nil {
+		p.log.debug("Error creating client", logFields{"vault": vault, "error": err})
+		return nil, errors.Wrapf(err, "Error getting client for vault '%s'", vault)
+	}
+	if _, random := kvClient.(randomSecretClient); p.cassette != nil && p.cassette.mode == cassetteModeRecord && !random {
+		kvClient = recordingClient{client: kvClient, vaultName: vault, cassette: p.cassette}
+	}
+	p.clients[vault] = kvClient
+	return kvClient, nil
+}
+
+// getSecretValues reads every secret, then the fallbacks of keys whose secrets do not exist. It returns the values
+// that were read and the errors reading the rest, keyed by secret reference. An error that fails the generator cancels
+// any outstanding reads and is returned as the error.
+func (p *plugin) getSecretValues() (map[string]string, map[string]error, error) {
+	values := make(map[string]string)
+	readErrors := make(map[string]error)
+	fatal := p.fatalRefs()
+	refs := p.getUniqueSecretNames()
+	for len(refs) > 0 {
+		err := p.readSecrets(refs, fatal, values, readErrors)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs = p.pendingFallbacks(values, readErrors)
+	}
+	return values, readErrors, nil
+}
+
+// readSecrets reads secRefs using up to Parallelism workers, adding them to values or readErrors
+func (p *plugin) readSecrets(secRefs []secretRef, fatal func(secretRef, error) bool, values map[string]string, readErrors map[string]error) error {
+	kvClients := make(map[string]iKvClient)
+	for _, r := range secRefs {
+		kvClient, err := p.getClient(r.vault)
+		if err != nil {
+			return err
+		}
+		kvClients[r.vault] = kvClient
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make([]secretValue, len(secRefs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < p.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = p.getSecretValue(ctx, kvClients[secRefs[i].vault], secRefs[i])
+				if results[i].err != nil && fatal(secRefs[i], results[i].err) {
+					cancel()
+				}
+			}
+		}()
+	}
+	for i := range secRefs {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	// Report the first error in name order (ignoring reads that were cancelled because of it) so that the result does
+	// not depend on which worker finished first
+	var cancelled error
+	for i, r := range secRefs {
+		if err := results[i].err; err != nil && fatal(r, err) {
+			if errors.Cause(err) != context.Canceled {
+				return err
+			}
+			cancelled = err
+		}
+	}
+	if cancelled != nil {
+		return cancelled
+	}
+	for i, r := range secRefs {
+		if results[i].err != nil {
+			readErrors[r.String()] = results[i].err
+		} else {
+			values[r.String()] = results[i].value
+		}
+	}
+	return nil
+}
+
+// pendingFallbacks returns the fallbacks that have to be read because the sources before them do not exist
+func (p *plugin) pendingFallbacks(values map[string]string, readErrors map[string]error) []secretRef {
+	var refs []secretRef
+	for _, s := range p.Secrets {
+		for _, key := range s.Keys {
+			m, ok := parseKey(key, p.vaultFor(s))
+			if !ok {
+				continue
+			}
+			for _, source := range m.sources() {
+				_, read := values[source.ref.String()]
+				err, failed := readErrors[source.ref.String()]
+				if !read && !failed && !contains(refs, source.ref) {
+					refs = append(refs, source.ref)
+				}
+				if !failed || !isNotFound(err) {
+					break
+				}
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs
+}
+
+// fatalRefs returns a function that tells whether an error reading a secret fails the generator. That is when the
+// secret is used by a secret without onError.warn, unless it does not exist and the keys that use it can do without it.
+func (p *plugin) fatalRefs() func(secretRef, error) bool {
+	// Whether each secret that is used by a secret without onError.warn must exist
+	required := make(map[string]bool)
+	for _, s := range p.Secrets {
+		if p.onErrorFor(s).Warn {
+			continue
+		}
+		noKeys := s
+		noKeys.Keys = nil
+		for _, ref := range p.secretRefs(noKeys) {
+			required[ref.String()] = true
+		}
+		for _, key := range s.Keys {
+			m, ok := parseKey(key, p.vaultFor(s))
+			if !ok {
+				continue
+			}
+			sources := m.sources()
+			for i, source := range sources {
+				last := i == len(sources)-1 && m.defaultValue == nil && !m.optional
+				required[source.ref.String()] = required[source.ref.String()] || last
+			}
+		}
+	}
+	return func(ref secretRef, err error) bool {
+		mustExist, ok := required[ref.String()]
+		return ok && (mustExist || !isNotFound(err))
+	}
+}
+
+func (p *plugin) getSecretValue(ctx context.Context, kvClient iKvClient, ref secretRef) secretValue {
+	if ctx.Err() != nil {
+		return secretValue{err: ctx.Err()}
+	}
+	start := time.Now()
+	p.log.debug("Reading secret", logFields{"vault": ref.vault, "secret": ref.id()})
+	sec, err := p.getLockedSecret(ctx, kvClient, ref)
+	if err != nil {
+		p.log.debug("Error reading secret", logFields{"vault": ref.vault, "secret": ref.id(), "duration": time.Since(start), "error": err})
+		return secretValue{err: errors.Wrapf(err, "Error getting secret '%s' from vault '%s'", ref.id(), ref.vault)}
+	}
+	p.redactor.add(sec.value)
+	p.log.debug("Read secret", logFields{"vault": ref.vault, "secret": ref.id(), "version": sec.version, "duration": time.Since(start)})
+	return secretValue{value: sec.value}
+}
+
+// workers returns how many secrets can be read at the same time
+func (p *plugin) workers() int {
+	if p.Parallelism < 1 {
+		return 1
+	}
+	return p.Parallelism
+}
+
+// getLockedSecret reads a secret. Unpinned secrets are read at the version in the lock file when locked and have
+// the version that was read recorded when updating, unless the version was made up (see locksVersions).
+func (p *plugin) getLockedSecret(ctx context.Context, kvClient iKvClient, ref secretRef) (*vaultSecret, error) {
+	version := ref.version
+	locked := p.lock != nil && ref.version == "" && p.lockMode() == lockModeLocked
+	update := p.lock != nil && ref.version == "" && p.lockMode() == lockModeUpdate && locksVersions(kvClient)
+	if locked {
+		entry, ok := p.lock.get(ref.vault, ref.name)
+		if !ok {
+			return nil, errors.Errorf("Secret '%s' from vault '%s' is not in the lock file %s. Set %s=%s to add it", ref.name, ref.vault, p.lockFilePath(), lockModeEnv, lockModeUpdate)
+		}
+		if entry.Missing {
+			return nil, notFoundError{vault: ref.vault, name: ref.name}
+		}
+		version = entry.Version
+	}
+	sec, err := kvClient.getSecret(ctx, ref.name, version)
+	if err != nil {
+		if update && isNotFound(err) {
+			p.lock.set(ref.vault, ref.name, "", true)
+		}
+		if locked {
+			return nil, errors.Wrapf(err, "Locked version '%s' of secret '%s' from vault '%s' is missing or disabled", version, ref.name, ref.vault)
+		}
+		return nil, err
+	}
+	if !sec.enabled {
+		return nil, errors.Errorf("Version '%s' of secret '%s' from vault '%s' is disabled", sec.version, ref.name, ref.vault)
+	}
+	if update {
+		p.lock.set(ref.vault, ref.name, sec.version, false)
+	}
+	return sec, nil
+}
+
+func (p *plugin) lockMode() string {
+	if mode := os.Getenv(lockModeEnv); mode != "" {
+		return mode
+	}
+	if p.LockMode == "" {
+		return lockModeLocked
+	}
+	return p.LockMode
+}
+
+// offlineSeed returns the seed for offline testing, the environment variable wins so that CI can force a seed
+func (p *plugin) offlineSeed() string {
+	if seed := os.Getenv(offlineTestingSeed); seed != "" {
+		return seed
+	}
+	return p.OfflineSeed
+}
+
+// lockFilePath returns the path of the lock file, relative paths are relative to the kustomization
+func (p *plugin) lockFilePath() string {
+	return p.kustomizationPath(p.LockFile)
+}
+
+// kustomizationPath returns the path of file relative to the kustomization unless it is absolute
+func (p *plugin) kustomizationPath(file string) string {
+	if filepath.IsAbs(file) || p.pluginHelper == nil {
+		return file
+	}
+	return filepath.Join(p.pluginHelper.Loader().Root(), file)
+}
+
+func (p *plugin) cassetteMode() string {
+	if mode := os.Getenv(cassetteModeEnv); mode != "" {
+		return mode
+	}
+	if p.CassetteMode == "" {
+		return cassetteModeReplay
+	}
+	return p.CassetteMode
+}
+
+func (p *plugin) cassetteValues() string {
+	if p.CassetteValues == "" {
+		return cassetteValuesRedacted
+	}
+	return p.CassetteValues
+}
+
+// loadCassette reads the cassette that responses are replayed from, or recorded in to. When recording the existing
+// interactions are kept so that generators sharing a cassette add to it.
+func (p *plugin) loadCassette() error {
+	p.cassette = nil
+	path := os.Getenv(cassetteEnv)
+	if path == "" && p.Cassette != "" {
+		path = p.kustomizationPath(p.Cassette)
+	}
+	if path == "" {
+		return nil
+	}
+	c := &cassette{path: path, mode: p.cassetteMode(), values: p.cassetteValues(), redactor: p.redactor}
+	if key := os.Getenv(cassetteKeyEnv); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		c.key = sum[:]
+	}
+	if c.values == cassetteValuesEncrypted && c.mode == cassetteModeRecord && c.key == nil {
+		return errors.Errorf("Recording encrypted values requires %s to be set", cassetteKeyEnv)
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && c.mode == cassetteModeRecord {
+		p.cassette = c
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error reading cassette %s", path)
+	}
+	err = yaml.Unmarshal(data, c)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing cassette %s", path)
+	}
+	p.cassette = c
+	return nil
+}
+
+func (p *plugin) saveCassette() error {
+	c := p.cassette
+	if c == nil || c.mode != cassetteModeRecord || !c.changed {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sort.Slice(c.Interactions, func(i, j int) bool { return c.Interactions[i].id() < c.Interactions[j].id() })
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "Error serializing cassette")
+	}
+	p.log.info("Writing cassette", logFields{"path": c.path})
+	var mode os.FileMode = 0644
+	if c.values == cassetteValuesPlain {
+		mode = 0600
+	}
+	err = ioutil.WriteFile(c.path, data, mode)
+	if err != nil {
+		return errors.Wrapf(err, "Error writing cassette %s", c.path)
+	}
+	c.changed = false
+	return nil
+}
+
+func (p *plugin) loadCache() error {
+	p.cache = nil
+	if p.CacheFile == "" {
+		return nil
+	}
+	p.cache = &placeholderCache{}
+	path := p.kustomizationPath(p.CacheFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error reading placeholder cache %s", path)
+	}
+	err = yaml.Unmarshal(data, p.cache)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing placeholder cache %s", path)
+	}
+	return nil
+}
+
+func (p *plugin) saveCache() error {
+	if p.cache == nil || !p.cache.changed {
+		return nil
+	}
+	data, err := yaml.Marshal(p.cache)
+	if err != nil {
+		return errors.Wrap(err, "Error serializing placeholder cache")
+	}
+	path := p.kustomizationPath(p.CacheFile)
+	p.log.info("Writing placeholder cache", logFields{"path": path})
+	// The cache contains secret values so only the owner can read it
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Error writing placeholder cache %s", path)
+	}
+	return nil
+}
+
+func (p *plugin) loadLock() error {
+	p.lock = nil
+	if p.LockFile == "" {
+		return nil
+	}
+	// In update mode the existing entries are kept, and only those that this generator reads are replaced, so that
+	// generators can share a lock file
+	data, err := ioutil.ReadFile(p.lockFilePath())
+	if os.IsNotExist(err) && p.lockMode() == lockModeUpdate {
+		p.lock = &secretLock{}
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return errors.Errorf("The lock file %s does not exist. Set %s=%s to create it", p.lockFilePath(), lockModeEnv, lockModeUpdate)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error reading lock file %s", p.lockFilePath())
+	}
+	lock := secretLock{}
+	err = yaml.Unmarshal(data, &lock)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing lock file %s", p.lockFilePath())
+	}
+	p.lock = &lock
+	return nil
+}
+
+func (p *plugin) saveLock() error {
+	if p.lock == nil || p.lockMode() != lockModeUpdate || !p.lock.changed {
+		return nil
+	}
+	sort.Slice(p.lock.Secrets, func(i, j int) bool {
+		a, b := p.lock.Secrets[i], p.lock.Secrets[j]
+		if a.Vault != b.Vault {
+			return a.Vault < b.Vault
+		}
+		return a.Name < b.Name
+	})
+	data, err := yaml.Marshal(p.lock)
+	if err != nil {
+		return errors.Wrap(err, "Error serializing lock file")
+	}
+	p.log.info("Writing lock file", logFields{"path": p.lockFilePath()})
+	err = ioutil.WriteFile(p.lockFilePath(), data, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Error writing lock file %s", p.lockFilePath())
+	}
+	return nil
+}
+
+// getUniqueSecretNames returns every secret name and version referenced by the secrets, sorted and without duplicates
+func (p *plugin) getUniqueSecretNames() []secretRef {
+	var refs []secretRef
+	for _, s := range p.Secrets {
+		for _, ref := range p.secretRefs(s) {
+			if !contains(refs, ref) {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs
+}
+
+// secretRefs returns every vault secret that s reads from its keys, templates, certificate and expand without
+// duplicates
+func (p *plugin) secretRefs(s innerSecret) []secretRef {
+	var refs []secretRef
+	add := func(ref secretRef) {
+		if !contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	for _, key := range s.Keys {
+		if m, ok := parseKey(key, p.vaultFor(s)); ok {
+			add(m.ref)
+		}
+	}
+	for _, body := range s.Templates {
+		_, sources, _ := parseTemplate("", body)
+		for _, source := range sources {
+			add(parseSource(source, p.vaultFor(s)).ref)
+		}
+	}
+	for _, r := range []string{s.Certificate, s.Expand} {
+		if r != "" {
+			add(parseRef(r, p.vaultFor(s)))
+		}
+	}
+	return refs
+}
+
+// getUniqueVaults returns every vault that secrets are read from, sorted and without duplicates
+func (p *plugin) getUniqueVaults() []string {
+	var vaults []string
+	for _, r := range p.getUniqueSecretNames() {
+		if len(vaults) == 0 || vaults[len(vaults)-1] != r.vault {
+			vaults = append(vaults, r.vault)
+		}
+	}
+	return vaults
+}
+
+func contains(arr []secretRef, ref secretRef) bool {
+	for _, a := range arr {
+		if a == ref {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *plugin) generateSecret(secret innerSecret, values map[string]string, options *types.GeneratorOptions) (resmap.ResMap, error) {
+	name, namespace, contents, err := p.generateContents(secret, values)
+	if err != nil {
+		return nil, err
+	}
+	args := types.SecretArgs{}
+	args.Name = name
+	args.Namespace = namespace
+	args.LiteralSources = contents
+	args.Type = secret.Type
+	return p.factory.FromSecretArgs(p.loader, secret.generatorOptions(options), args)
+}
+
+func (p *plugin) outputAsConfigMap(secret innerSecret, values map[string]string, options *types.GeneratorOptions) (resmap.ResMap, error) {
+	name, namespace, contents, err := p.generateContents(secret, values)
+	if err != nil {
+		return nil, err
+	}
+	args := types.ConfigMapArgs{}
+	args.Name = name
+	args.Namespace = namespace
+	args.LiteralSources = contents
+	return p.factory.FromConfigMapArgs(p.loader, secret.generatorOptions(options), args)
+}
+
+func (p *plugin) generateContents(secret innerSecret, values map[string]string) (string, string, []string, error) {
+	name := secret.Name
+	namespace := secret.Namespace
+	var contents []string
+
+	if name == "" {
+		name = p.Name
+	}
+	if namespace == "" {
+		namespace = p.Namespace
+	}
+	if name == "" {
+		return "", "", nil, errors.Errorf("Secret is missing name: %v", secret)
+	}
+	if namespace == "" {
+		return "", "", nil, errors.Errorf("Secret is missing namespace: %v", secret)
+	}
+
+	for _, key := range secret.Keys {
+		m, ok := parseKey(key, p.vaultFor(secret))
+		if ok {
+			v, ok, err := p.keyValue(secret, m, values)
+			if err != nil {
+				return "", "", nil, err
+			}
+			if ok {
+				contents = append(contents, m.key+"="+v)
+			}
+		}
+	}
+	for _, k := range sortedKeys(secret.Templates) {
+		// Templates of secrets that could not be read are replaced with placeholders, they would fail to render
+		if secret.Errored {
+			contents = append(contents, k+"="+placeholderMarker)
+			continue
+		}
+		v, err := p.renderTemplate(secret, k, values)
+		if err != nil {
+			return "", "", nil, err
+		}
+		contents = append(contents, k+"="+v)
+	}
+	if secret.Expand != "" {
+		ref := parseRef(secret.Expand, p.vaultFor(secret))
+		if v, ok := values[ref.String()]; ok && !secret.Errored && !p.isOffline(ref.vault) {
+			v, err := applyTransforms(v, secret.transforms(), "secret '"+ref.id()+"'")
+			if err != nil {
+				return "", "", nil, err
+			}
+			expanded, err := expandSecret(v, secret.Format)
+			if err != nil {
+				return "", "", nil, errors.Wrapf(err, "Could not expand secret '%s' from vault '%s'", ref.id(), ref.vault)
+			}
+			for _, k := range sortedKeys(expanded) {
+				if matchesAny(secret.Include, k, true) && !matchesAny(secret.Exclude, k, false) {
+					contents = append(contents, secret.Prefix+k+"="+expanded[k])
+				}
+			}
+		}
+	}
+	if secret.Certificate != "" {
+		ref := parseRef(secret.Certificate, p.vaultFor(secret))
+		if v, ok := values[ref.String()]; ok {
+			crt, key, err := p.tlsContents(secret, ref, v)
+			if err != nil {
+				return "", "", nil, errors.Wrapf(err, "Could not read certificate '%s' from vault '%s'", ref.id(), ref.vault)
+			}
+			contents = append(contents, "tls.crt="+crt, "tls.key="+key)
+		}
+	}
+	id := namespace + "/" + name
+	if secret.Errored {
+		var err error
+		contents, err = p.placeholderContents(secret, id, contents)
+		if err != nil {
+			return "", "", nil, err
+		}
+	} else if p.onErrorFor(secret).Placeholder.strategy() == placeholderPrevious && !p.isOfflineSecret(secret) {
+		p.cache.set(id, contents)
+	}
+	if secret.Type == secretTypeDockerConfigJSON {
+		dockerConfig, err := dockerConfigJSON(contents)
+		if err != nil {
+			return "", "", nil, errors.Wrapf(err, "Could not create %s for secret '%s'", secretTypeDockerConfigJSON, name)
+		}
+		contents = []string{".dockerconfigjson=" + dockerConfig}
+	}
+	for _, c := range contents {
+		p.redactor.add(c[strings.Index(c, "=")+1:])
+	}
+	return name, namespace, contents, nil
+}
+
+// dockerConfigJSON builds the .dockerconfigjson of an image pull secret from the registry, username, password and
+// email keys
+func dockerConfigJSON(contents []string) (string, error) {
+	values := map[string]string{}
+	for _, c := range contents {
+		kv := strings.SplitN(c, "=", 2)
+		values[kv[0]] = kv[1]
+	}
+	type dockerAuth struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email,omitempty"`
+		Auth     string `json:"auth"`
+	}
+	config := struct {
+		Auths map[string]dockerAuth `json:"auths"`
+	}{
+		Auths: map[string]dockerAuth{
+			values["registry"]: {
+				Username: values["username"],
+				Password: values["password"],
+				Email:    values["email"],
+				Auth:     base64.StdEncoding.EncodeToString([]byte(values["username"] + ":" + values["password"])),
+			},
+		},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", errors.New("Error encoding docker config")
+	}
+	return string(data), nil
+}
+
+// keyValue returns the value of a key mapping from the first of its sources that exists. The secret's transforms are
+// applied to the vault secret, then the JSON path is selected and then the key's own transforms are applied.
+// Placeholders and default values are returned as they are, optional keys without a value return false.
+func (p *plugin) keyValue(secret innerSecret, m keyMapping, values map[string]string) (string, bool, error) {
+	if secret.Errored {
+		v, ok := values[m.ref.String()]
+		return v, ok, nil
+	}
+	m, v, ok := m.resolve(values)
+	if !ok {
+		if m.defaultValue != nil {
+			return *m.defaultValue, true, nil
+		}
+		return "", false, nil
+	}
+	if p.isOffline(m.ref.vault) {
+		return v, true, nil
+	}
+	what := "key '" + m.key + "'"
+	v, err := applyTransforms(v, secret.transforms(), what)
+	if err != nil {
+		return "", false, err
+	}
+	if m.path != "" {
+		v, err = selectJSONPath(v, m.path)
+		if err != nil {
+			return "", false, errors.Wrapf(err, "Could not read key '%s' from secret '%s' in vault '%s'", m.key, m.ref.id(), m.ref.vault)
+		}
+	}
+	v, err = applyTransforms(v, m.transforms, what)
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+// transforms returns the transforms that are applied to every vault secret read by this secret
+func (s innerSecret) transforms() []string {
+	if s.Base64Decode {
+		return append([]string{"base64decode"}, s.Transforms...)
+	}
+	return s.Transforms
+}
+
+// valueTransforms are the transforms that can be applied to values. Their errors must never include the value.
+var valueTransforms = map[string]func(string) (string, error){
+	"base64decode": func(v string) (string, error) {
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return "", errors.New("Value is not base64 encoded")
+		}
+		return string(data), nil
+	},
+	"base64encode": func(v string) (string, error) {
+		return base64.StdEncoding.EncodeToString([]byte(v)), nil
+	},
+	"base64urldecode": func(v string) (string, error) {
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+		if err != nil {
+			return "", errors.New("Value is not base64url encoded")
+		}
+		return string(data), nil
+	},
+	"base64urlencode": func(v string) (string, error) {
+		return base64.URLEncoding.EncodeToString([]byte(v)), nil
+	},
+	"hexdecode": func(v string) (string, error) {
+		data, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return "", errors.New("Value is not hex encoded")
+		}
+		return string(data), nil
+	},
+	"gunzip": func(v string) (string, error) {
+		reader, err := gzip.NewReader(strings.NewReader(v))
+		if err != nil {
+			return "", errors.New("Value is not gzip compressed")
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return "", errors.New("Value could not be decompressed")
+		}
+		return string(data), nil
+	},
+	"trim": func(v string) (string, error) {
+		return strings.TrimSpace(v), nil
+	},
+	"pem": normalisePEM,
+	"jsonminify": func(v string) (string, error) {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(v)); err != nil {
+			return "", errors.New("Value is not JSON")
+		}
+		return buf.String(), nil
+	},
+}
+
+var pemBlockPattern = regexp.MustCompile(`-----BEGIN ([A-Z0-9 ]+)-----([^-]*)-----END ([A-Z0-9 ]+)-----`)
+
+// normalisePEM re-encodes every PEM block in a value with the standard line length and line endings. Blocks that
+// have had their line breaks replaced with spaces or \n (as often happens when they are pasted in to the portal)
+// are repaired.
+func normalisePEM(v string) (string, error) {
+	v = strings.Replace(v, `\n`, "\n", -1)
+	matches := pemBlockPattern.FindAllStringSubmatch(v, -1)
+	if len(matches) == 0 {
+		return "", errors.New("Value does not contain any PEM blocks")
+	}
+	var buf bytes.Buffer
+	for _, match := range matches {
+		if match[1] != match[3] {
+			return "", errors.Errorf("PEM block %s ends with %s", match[1], match[3])
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(match[2]), ""))
+		if err != nil {
+			return "", errors.Errorf("PEM block %s is not base64 encoded", match[1])
+		}
+		pem.Encode(&buf, &pem.Block{Type: match[1], Bytes: data})
+	}
+	return buf.String(), nil
+}
+
+func validateTransforms(names []string) error {
+	for _, name := range names {
+		if _, ok := valueTransforms[name]; !ok {
+			return errors.Errorf("Unknown transform '%s'", name)
+		}
+	}
+	return nil
+}
+
+// applyTransforms applies each transform to value in order, what describes the value in errors
+func applyTransforms(value string, names []string, what string) (string, error) {
+	for _, name := range names {
+		var err error
+		value, err = valueTransforms[name](value)
+		if err != nil {
+			return "", errors.Wrapf(err, "Could not apply transform '%s' to %s", name, what)
+		}
+	}
+	return value, nil
+}
+
+// renderTemplate renders the template for key, the secret function reads key mappings in the same way as keys
+func (p *plugin) renderTemplate(secret innerSecret, key string, values map[string]string) (string, error) {
+	t, _, err := parseTemplate(key, secret.Templates[key])
+	if err != nil {
+		return "", errors.Wrapf(err, "Secret '%s' has an invalid template for key '%s'", secret.Name, key)
+	}
+	t.Funcs(templateFuncs(func(source string) (string, error) {
+		m := parseSource(source, p.vaultFor(secret))
+		m.key = key
+		v, ok, err := p.keyValue(secret, m, values)
+		if err == nil && !ok {
+			err = errors.Errorf("Secret '%s' was not read from vault '%s'", m.ref.id(), m.ref.vault)
+		}
+		return v, err
+	}))
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, nil); err != nil {
+		return "", errors.Wrapf(err, "Could not render the template for key '%s'", key)
+	}
+	return buf.String(), nil
+}
+
+// templateFuncs returns the functions that are available to templates, secret looks up the value of a vault secret
+func templateFuncs(secret func(string) (string, error)) template.FuncMap {
+	return template.FuncMap{
+		"secret": secret,
+		"b64enc": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"b64dec": func(s string) (string, error) {
+			data, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return "", errors.New("Value is not base64 encoded")
+			}
+			return string(data), nil
+		},
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return "", errors.New("Value can not be encoded as JSON")
+			}
+			return string(data), nil
+		},
+		"indent": func(spaces int, s string) string {
+			pad := strings.Repeat(" ", spaces)
+			return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+		},
+	}
+}
+
+// parseTemplate parses a template and returns the key mappings that it passes to secret. These must be string
+// literals so that the vault secrets can be read before the template is rendered.
+func parseTemplate(name string, body string) (*template.Template, []string, error) {
+	t, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs(nil)).Parse(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sources []string
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			if err := templateSources(tmpl.Tree.Root, &sources); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return t, sources, nil
+}
+
+func templateSources(node parse.Node, sources *[]string) error {
+	var children []parse.Node
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			children = n.Nodes
+		}
+	case *parse.ActionNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.IfNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.WithNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.TemplateNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				children = append(children, cmd)
+			}
+		}
+	case *parse.CommandNode:
+		for i, arg := range n.Args {
+			if id, ok := arg.(*parse.IdentifierNode); ok && id.Ident == "secret" {
+				var str *parse.StringNode
+				if i == 0 && len(n.Args) == 2 {
+					str, _ = n.Args[1].(*parse.StringNode)
+				}
+				if str == nil {
+					return errors.New("secret must be given the name of a vault secret as a string, e.g. {{ secret \"name\" }}")
+				}
+				*sources = append(*sources, str.Text)
+			}
+		}
+		children = n.Args
+	}
+	for _, child := range children {
+		if err := templateSources(child, sources); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandSecret parses a vault secret in the given format and returns each of its top level entries
+func expandSecret(value string, format string) (map[string]string, error) {
+	switch format {
+	case formatDotenv:
+		return parseDotenv(value)
+	case formatProperties:
+		return parseProperties(value)
+	case formatYAML:
+		data, err := yaml.YAMLToJSON([]byte(value))
+		if err != nil {
+			return nil, errors.New("Value is not YAML")
+		}
+		value = string(data)
+	}
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil || doc == nil {
+		return nil, errors.Errorf("Value is not a %s object", format)
+	}
+	entries := make(map[string]string, len(doc))
+	for k, v := range doc {
+		switch v := v.(type) {
+		case string:
+			entries[k] = v
+		case json.Number:
+			entries[k] = v.String()
+		default:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, errors.Errorf("Error encoding '%s'", k)
+			}
+			entries[k] = string(data)
+		}
+	}
+	return entries, nil
+}
+
+// parseDotenv parses KEY=value lines, blank lines, comments and export prefixes are ignored and quotes are removed
+// from values. Escapes (e.g. \n) are only expanded in double quoted values.
+func parseDotenv(value string) (map[string]string, error) {
+	entries := map[string]string{}
+	for i, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		kv := strings.SplitN(line, "=", 2)
+		k := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || k == "" {
+			return nil, errors.Errorf("Line %d is not in the form KEY=value", i+1)
+		}
+		v := strings.TrimSpace(kv[1])
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			unquoted, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, errors.Errorf("Line %d has an invalid quoted value", i+1)
+			}
+			v = unquoted
+		} else if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+			v = v[1 : len(v)-1]
+		}
+		entries[k] = v
+	}
+	return entries, nil
+}
+
+// parseProperties parses a Java properties file. Keys are separated from values by =, : or whitespace, lines ending
+// in a backslash are continued on the next line and lines starting with # or ! are comments.
+func parseProperties(value string) (map[string]string, error) {
+	entries := map[string]string{}
+	lines := strings.Split(value, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimLeft(lines[i], " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		for strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") && i+1 < len(lines) {
+			i++
+			line = line[:len(line)-1] + strings.TrimLeft(lines[i], " \t\f")
+		}
+		line = strings.TrimRight(line, "\r")
+		var key []rune
+		rest := ""
+		escaped := false
+		for j, c := range line {
+			if escaped {
+				key = append(key, unescapeProperty(c))
+				escaped = false
+				continue
+			}
+			if c == '\\' {
+				escaped = true
+				continue
+			}
+			if c == '=' || c == ':' || c == ' ' || c == '\t' || c == '\f' {
+				rest = strings.TrimLeft(line[j:], " \t\f")
+				if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+					rest = strings.TrimLeft(rest[1:], " \t\f")
+				}
+				break
+			}
+			key = append(key, c)
+		}
+		if len(key) == 0 {
+			return nil, errors.Errorf("Line %d does not have a key", i+1)
+		}
+		var v []rune
+		escaped = false
+		for _, c := range rest {
+			if escaped {
+				v = append(v, unescapeProperty(c))
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else {
+				v = append(v, c)
+			}
+		}
+		entries[string(key)] = string(v)
+	}
+	return entries, nil
+}
+
+func unescapeProperty(c rune) rune {
+	switch c {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'f':
+		return '\f'
+	}
+	return c
+}
+
+// matchesAny returns true if name matches any of the glob patterns, or empty if there aren't any patterns
+func matchesAny(patterns []string, name string, empty bool) bool {
+	if len(patterns) == 0 {
+		return empty
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseJSONPath parses a path such as $.servers[0].host or $['key.with.dots'] in to a list of object keys (strings)
+// and array indexes (ints)
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.Errorf("Path '%s' must start with $", path)
+	}
+	var segments []interface{}
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, errors.Errorf("Path '%s' has an empty field name", path)
+			}
+			segments = append(segments, rest[1:end+1])
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest[2:], string(rest[1])+"]")
+			if end < 0 {
+				return nil, errors.Errorf("Path '%s' has an unterminated field name", path)
+			}
+			segments = append(segments, rest[2:end+2])
+			rest = rest[end+4:]
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, errors.Errorf("Path '%s' has an unterminated index", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, errors.Errorf("Path '%s' has an invalid index '%s'", path, rest[1:end])
+			}
+			segments = append(segments, index)
+			rest = rest[end+1:]
+		default:
+			return nil, errors.Errorf("Path '%s' is invalid at '%s'", path, rest)
+		}
+	}
+	return segments, nil
+}
+
+// selectJSONPath returns the value at path in a JSON document. Strings are returned as they are, anything else is
+// returned as JSON.
+func selectJSONPath(value string, path string) (string, error) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return "", errors.Errorf("Value is not JSON so path '%s' can not be read", path)
+	}
+	for _, segment := range segments {
+		found := false
+		switch s := segment.(type) {
+		case string:
+			var obj map[string]interface{}
+			if obj, found = doc.(map[string]interface{}); found {
+				doc, found = obj[s]
+			}
+		case int:
+			var arr []interface{}
+			if arr, found = doc.([]interface{}); found && s < len(arr) {
+				doc = arr[s]
+			} else {
+				found = false
+			}
+		}
+		if !found {
+			return "", errors.Errorf("Path '%s' was not found", path)
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", errors.Errorf("Error encoding the value at path '%s'", path)
+	}
+	return string(data), nil
+}
+
+// isOffline returns true if the secrets in vault are made up rather than being read from Key Vault
+func (p *plugin) isOffline(vault string) bool {
+	_, ok := p.clients[vault].(randomSecretClient)
+	return ok
+}
+
+// isOfflineSecret returns true if any of the vault secrets that secret uses are made up
+func (p *plugin) isOfflineSecret(secret innerSecret) bool {
+	for _, ref := range p.secretRefs(secret) {
+		if p.isOffline(ref.vault) {
+			return true
+		}
+	}
+	return false
+}
+
+// isProduction returns true when AZURE_SECRETS_ENVIRONMENT says that we are building for production
+func isProduction() bool {
+	env := strings.ToLower(os.Getenv(environmentEnv))
+	return env == "prod" || env == "production"
+}
+
+// isStrict returns true if secrets that could not be read must not be output with placeholders
+func (p *plugin) isStrict() bool {
+	return p.Strict || isProduction()
+}
+
+// offlinePolicy matches the secrets that must never be made up, either by namespace or by a label selector
+type offlinePolicy struct {
+	entry     string
+	namespace string
+	selector  labels.Selector
+}
+
+var namespaceRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// parseOfflinePolicy parses an entry of forbidOfflineFor. Entries that are valid namespace names are namespaces,
+// anything else is a label selector such as env=prod or tier in (prod, staging).
+func parseOfflinePolicy(entry string) (offlinePolicy, error) {
+	if namespaceRegex.MatchString(entry) {
+		return offlinePolicy{entry: entry, namespace: entry}, nil
+	}
+	selector, err := labels.Parse(entry)
+	if err != nil || selector.Empty() {
+		return offlinePolicy{}, errors.Errorf("Invalid forbidOfflineFor '%s', expected a namespace or a label selector", entry)
+	}
+	return offlinePolicy{entry: entry, selector: selector}, nil
+}
+
+func (o offlinePolicy) matches(namespace string, secretLabels map[string]string) bool {
+	if o.selector != nil {
+		return o.selector.Matches(labels.Set(secretLabels))
+	}
+	return o.namespace == namespace
+}
+
+// isFakeClient returns true if client doesn't read from a real vault
+func isFakeClient(client iKvClient) bool {
+	switch c := client.(type) {
+	case randomSecretClient, testClient, fixtureClient, replayClient:
+		return true
+	case recordingClient:
+		return isFakeClient(c.client)
+	}
+	return false
+}
+
+// locksVersions returns false if the versions that client returns are made up by the offline, fixture or replay
+// clients and must not be written to the lock file. The test vault stands in for Key Vault in the plugin's own tests
+// so its versions are recorded.
+func locksVersions(client iKvClient) bool {
+	if c, ok := client.(recordingClient); ok {
+		client = c.client
+	}
+	if _, ok := client.(testClient); ok {
+		return true
+	}
+	return !isFakeClient(client)
+}
+
+// checkOfflinePolicy returns an error if secret would be made up but is in a namespace or has labels that
+// forbidOfflineFor protects, or if we are building for production
+func (p *plugin) checkOfflinePolicy(secret innerSecret) error {
+	namespace := secret.Namespace
+	if namespace == "" {
+		namespace = p.Namespace
+	}
+	reason := ""
+	if isProduction() {
+		reason = fmt.Sprintf("%s is '%s'", environmentEnv, os.Getenv(environmentEnv))
+	}
+	for _, policy := range p.forbidOffline {
+		if reason == "" && policy.matches(namespace, secret.generatorOptions(nil).Labels) {
+			reason = fmt.Sprintf("it matches forbidOfflineFor '%s'", policy.entry)
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+	for _, ref := range p.secretRefs(secret) {
+		if isFakeClient(p.clients[ref.vault]) {
+			return errors.Errorf("Secret '%s' in namespace '%s' must be read from a real vault because %s, but vault '%s' is offline, a fixture, a cassette or a test vault", secret.Name, namespace, reason, ref.vault)
+		}
+	}
+	return nil
+}
+
+// tlsContents returns the tls.crt and tls.key of a certificate. When the certificate could not be read both contain
+// the error placeholder and when testing offline they contain a new self signed certificate.
+func (p *plugin) tlsContents(secret innerSecret, ref secretRef, value string) (string, string, error) {
+	if secret.Errored {
+		return value, value, nil
+	}
+	if p.isOffline(ref.vault) {
+		return p.clients[ref.vault].(randomSecretClient).certificate(ref.name)
+	}
+	return certificateToPEM(value)
+}
+
+// certificateToPEM converts the value of a certificate backed secret, which is either a PEM file or a base64 encoded
+// PFX file, to the PEM encoded certificate chain (leaf first) and private key
+func certificateToPEM(value string) (string, string, error) {
+	var blocks []*pem.Block
+	if strings.Contains(value, "-----BEGIN") {
+		for block, rest := pem.Decode([]byte(value)); block != nil; block, rest = pem.Decode(rest) {
+			blocks = append(blocks, block)
+		}
+	} else {
+		pfx, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", "", errors.New("Certificate is not a PEM file or a base64 encoded PFX file")
+		}
+		blocks, err = pkcs12.ToPEM(pfx, "")
+		if err != nil {
+			return "", "", errors.Wrap(err, "Error decoding PFX file")
+		}
+	}
+
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return "", "", errors.Wrap(err, "Error decoding certificate")
+			}
+			certs = append(certs, cert)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			var err error
+			key, err = parsePrivateKey(block.Bytes)
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+	if key == nil || len(certs) == 0 {
+		return "", "", errors.New("Certificate must contain a certificate and a private key")
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return "", "", errors.Wrap(err, "Error encoding public key")
+	}
+	var leaf []byte
+	var chain []byte
+	for _, cert := range certs {
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if leaf == nil && bytes.Equal(cert.RawSubjectPublicKeyInfo, publicKey) {
+			leaf = block
+		} else {
+			chain = append(chain, block...)
+		}
+	}
+	if leaf == nil {
+		return "", "", errors.New("None of the certificates match the private key")
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Error encoding private key")
+	}
+	return string(append(leaf, chain...)), string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})), nil
+}
+
+// parsePrivateKey parses a PKCS #8, PKCS #1 or EC private key. PFX files decode keys as "PRIVATE KEY" whatever their
+// format so the type of the PEM block can't be relied on.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(der); err != nil {
+			if key, err = x509.ParseECPrivateKey(der); err != nil {
+				return nil, errors.New("Error decoding private key")
+			}
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("Unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func (p *plugin) getKvClient(vaultName string) (iKvClient, error) {
+	if p.cassette != nil && p.cassette.mode == cassetteModeReplay {
+		return replayClient{vaultName: vaultName, cassette: p.cassette}, nil
+	}
+	if strings.HasPrefix(vaultName, fixturesScheme) {
+		path := strings.TrimPrefix(vaultName, fixturesScheme)
+		section := ""
+		if i := strings.LastIndex(path, "#"); i >= 0 {
+			path, section = path[:i], path[i+1:]
+		}
+		return newFixtureClient(vaultName, p.kustomizationPath(path), section)
+	}
+	if fixtures := os.Getenv(fixturesEnv); fixtures != "" {
+		return newFixtureClient(vaultName, fixtures, vaultName)
+	}
+	if os.Getenv(offlineTestingMode) != "" {
+		if os.Getenv(offlineRefuseInCI) != "" && os.Getenv("CI") != "false" {
+			return nil, errors.Errorf("%s is set but %s is set and CI is not 'false', refusing to make up secrets", offlineTestingMode, offlineRefuseInCI)
+		}
+		return randomSecretClient{vaultName: vaultName, seed: p.offlineSeed()}, nil
+	}
+	// Kustomize plugins don't seem to support DI'ing mocks :(
+	if strings.HasPrefix(vaultName, testVaultName) {
+		return testClient{vaultName: vaultName}, nil
+	}
+
+	authorizer, err := p.getAuthorizer()
+	if err != nil {
+		return nil, err
+	}
+
+	basicClient := keyvault.New()
+	basicClient.Authorizer = authorizer
+	client := azKvClient{&basicClient, vaultName, p.vaultBaseURL(vaultName), p.Retry, p.log}
+
+	return client, nil
+}
+
+// getAuthorizer creates the authorizer for Key Vault requests the first time that it is needed, tokens are requested
+// straight away so that authentication problems are reported before any secrets are read
+func (p *plugin) getAuthorizer() (autorest.Authorizer, error) {
+	if p.authorizer != nil {
+		return p.authorizer, nil
+	}
+	env, err := p.environment()
+	if err != nil {
+		return nil, err
+	}
+	resource := p.keyVaultResource(env)
+	var spt refreshableToken
+	switch p.Auth.Type {
+	case authTypeAzureCli:
+		command := p.Auth.AzCommand
+		if command == "" {
+			command = "az"
+		}
+		spt = &azureCliToken{command: command, resource: resource, tenantID: p.Auth.TenantID}
+		p.log.info("Using Azure CLI auth", logFields{"command": command})
+	case authTypeManagedIdentity:
+		endpoint := p.Auth.IdentityEndpoint
+		if endpoint == "" {
+			endpoint, _ = adal.GetMSIVMEndpoint()
+		}
+		if p.Auth.ClientID == "" {
+			spt, err = adal.NewServicePrincipalTokenFromMSI(endpoint, resource)
+		} else {
+			spt, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(endpoint, resource, p.Auth.ClientID)
+		}
+		p.log.info("Using managed identity auth", logFields{"clientId": p.Auth.ClientID})
+	case authTypeWorkloadIdentity:
+		tokenFile := valueOrEnv(p.Auth.TokenFile, azureFederatedTokenFile)
+		if tokenFile == "" {
+			return nil, errors.Errorf("Workload identity requires auth.tokenFile or %s to be set", azureFederatedTokenFile)
+		}
+		var oauthConfig *adal.OAuthConfig
+		oauthConfig, err = p.Auth.oauthConfig(env)
+		if err == nil {
+			spt, err = adal.NewServicePrincipalTokenWithSecret(*oauthConfig, p.Auth.clientID(), resource, &federatedTokenSecret{tokenFile})
+		}
+		p.log.info("Using workload identity auth", logFields{"clientId": p.Auth.clientID()})
+	case authTypeClientCertificate:
+		certPath := valueOrEnv(p.Auth.CertificatePath, azureClientCertificatePath)
+		if certPath == "" {
+			return nil, errors.Errorf("Client certificate auth requires auth.certificatePath or %s to be set", azureClientCertificatePath)
+		}
+		var oauthConfig *adal.OAuthConfig
+		oauthConfig, err = p.Auth.oauthConfig(env)
+		if err == nil {
+			var cert *x509.Certificate
+			var key *rsa.PrivateKey
+			cert, key, err = readCertificate(certPath, os.Getenv(azureClientCertificatePassword))
+			if err == nil {
+				spt, err = adal.NewServicePrincipalTokenFromCertificate(*oauthConfig, p.Auth.clientID(), cert, key, resource)
+			}
+		}
+		p.log.info("Using client certificate auth", logFields{"clientId": p.Auth.clientID()})
+	default:
+		p.authorizer, err = getEnvironmentAuthorizer(p.Auth.Type, env, resource, p.log)
+		return p.authorizer, err
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to create %s authorizer", p.Auth.Type)
+	}
+	err = spt.EnsureFreshWithContext(context.Background())
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get a token using %s auth", p.Auth.Type)
+	}
+	p.authorizer = autorest.NewBearerAuthorizer(spt)
+	return p.authorizer, nil
+}
+
+// getEnvironmentAuthorizer uses the service principal in the environment variables or in AZURE_AUTH_LOCATION
+func getEnvironmentAuthorizer(authType string, env azure.Environment, resource string, log *logger) (autorest.Authorizer, error) {
+	authFile := os.Getenv(azureAuthLocation)
+	if authType == authTypeEnvironment {
+		authFile = ""
+	}
+	if os.Getenv(disableAzureAuthValidation) == "" {
+		if authType == authTypeFile && authFile == "" {
+			return nil, errors.New(fmt.Sprintf("The environment variable %s should be set. Or set %s to bypass this check.", azureAuthLocation, disableAzureAuthValidation))
+		}
+		if authFile == "" {
+			if os.Getenv(azureTenantID) == "" || os.Getenv(azureClientID) == "" || os.Getenv(azureClientSecret) == "" {
+				return nil, errors.New(fmt.Sprintf("The environment variables: %s, %s, %s should be set. Or set %s to bypass this check.", azureTenantID, azureClientID, azureClientSecret, disableAzureAuthValidation))
+			}
+		} else {
+			if _, err := os.Stat(authFile); os.IsNotExist(err) {
+				return nil, errors.New(fmt.Sprintf("%s does not exist", authFile))
+			}
+		}
+	}
+
+	var authorizer autorest.Authorizer
+	var err error
+	if authFile == "" {
+		var settings azauth.EnvironmentSettings
+		settings, err = azauth.GetSettingsFromEnvironment()
+		if err == nil {
+			settings.Environment = env
+			settings.Values[azauth.Resource] = resource
+			authorizer, err = settings.GetAuthorizer()
+		}
+		log.info("Using env based auth", logFields{"clientId": os.Getenv(azureClientID)})
+	} else {
+		authorizer, err = azauth.NewAuthorizerFromFileWithResource(resource)
+		log.info("Using file based auth", logFields{"path": authFile})
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create vault authorizer")
+	}
+	return authorizer, nil
+}
+
+// environment returns the Azure cloud that the vaults are in, this defaults to AZURE_ENVIRONMENT or the public cloud
+func (p *plugin) environment() (azure.Environment, error) {
+	if p.Cloud != "" {
+		return clouds[p.Cloud], nil
+	}
+	if name := os.Getenv(azureEnvironment); name != "" {
+		env, err := azure.EnvironmentFromName(name)
+		return env, errors.Wrapf(err, "Invalid %s", azureEnvironment)
+	}
+	return azure.PublicCloud, nil
+}
+
+// vaultBaseURL returns the data plane URL of a vault, {vault} in VaultURL is replaced with the name of the vault
+func (p *plugin) vaultBaseURL(vault string) string {
+	if p.VaultURL != "" {
+		return strings.Replace(p.VaultURL, "{vault}", vault, -1)
+	}
+	env, err := p.environment()
+	if err != nil {
+		env = azure.PublicCloud
+	}
+	return "https://" + vault + "." + env.KeyVaultDNSSuffix
+}
+
+// keyVaultResource returns the resource that tokens are requested for. If VaultURL points at a vault in any Azure
+// cloud then that cloud's Key Vault resource is used.
+func (p *plugin) keyVaultResource(env azure.Environment) string {
+	if resource := os.Getenv(azureKeyVaultResource); resource != "" {
+		return resource
+	}
+	if u, err := url.Parse(p.vaultBaseURL("vault")); p.VaultURL != "" && err == nil {
+		for _, cloud := range clouds {
+			if strings.HasSuffix(u.Hostname(), "."+cloud.KeyVaultDNSSuffix) {
+				return strings.TrimSuffix(cloud.KeyVaultEndpoint, "/")
+			}
+		}
+	}
+	return strings.TrimSuffix(env.KeyVaultEndpoint, "/")
+}
+
+type iKvClient interface {
+	getSecret(ctx context.Context, name string, version string) (*vaultSecret, error)
+}
+
+type azKvClient struct {
+	client    *keyvault.BaseClient
+	vaultName string
+	baseURL   string
+	retry     retryPolicy
+	log       *logger
+}
+
+func (kvc azKvClient) getSecret(ctx context.Context, name string, version string) (_ *vaultSecret, err error) {
+	defer func() {
+		if recoveredErr := recover(); recoveredErr != nil {
+			err = errors.Errorf("Error getting secret '%s' from vault '%s' %v", name, kvc.vaultName, recoveredErr)
+			kvc.log.error("Error reading secret", logFields{"vault": kvc.vaultName, "secret": name, "error": err})
+		}
+	}()
+	// The SDK retries throttled requests forever by default, replacing its send decorators leaves retrying to the policy
+	sendCtx := autorest.WithSendDecorators(ctx, []autorest.SendDecorator{func(s autorest.Sender) autorest.Sender { return s }})
+	var res keyvault.SecretBundle
+	attempt := 1
+	for {
+		res, err = kvc.client.GetSecret(sendCtx, kvc.baseURL, name, version)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		retryable, retryAfter := kvc.retry.classify(err)
+		if !retryable || attempt >= kvc.retry.MaxAttempts {
+			break
+		}
+		delay := kvc.retry.delay(attempt, retryAfter)
+		kvc.log.warn("Retrying read", logFields{"vault": kvc.vaultName, "secret": name, "version": version, "attempt": attempt, "delay": delay, "error": err})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		attempt++
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading version '%s' from %s after %d attempt(s)", version, kvc.vaultName, attempt)
+	}
+	sec := vaultSecret{value: *res.Value, version: version, enabled: true}
+	if res.ID != nil {
+		// IDs look like https://myvault.vault.azure.net/secrets/name/version
+		sec.version = path.Base(*res.ID)
+	}
+	if res.Attributes != nil && res.Attributes.Enabled != nil {
+		sec.enabled = *res.Attributes.Enabled
+	}
+	return &sec, nil
+}
+
+// randomString returns length characters chosen from charset using crypto/rand
+func randomString(length int, charset string) (string, error) {
+	chars := []rune(charset)
+	max := big.NewInt(int64(len(chars)))
+	random := make([]rune, length)
+	for i := range random {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "Error generating random characters")
+		}
+		random[i] = chars[n.Int64()]
+	}
+	return string(random), nil
+}
+
+// randomSecretClient makes up secrets when testing offline. With a seed every value is derived from the seed, vault
+// and name so that builds are repeatable, otherwise they are random.
+type randomSecretClient struct {
+	vaultName string
+	seed      string
+}
+
+// offlineWarning makes sure that the user is only warned about offline testing once, however many generators and
+// secrets are read
+var offlineWarning sync.Once
+
+// warnUser prints a warning (once per process) and then pauses for AZURE_SECRETS_OFFLINE_TESTING_MODE_WARN_SECONDS if
+// it is set
+func (kvc randomSecretClient) warnUser() {
+	offlineWarning.Do(func() {
+		printOfflineWarning(kvc.vaultName)
+	})
+}
+
+func printOfflineWarning(vaultName string) {
+	const red = "\033[1;31m"
+	const noColour = "\033[0m"
+	fmt.Fprintf(os.Stderr, "\n%sWarning whilst reading from vault:\n%s%s\n", red, vaultName, noColour)
+	fmt.Fprintf(os.Stderr, "%s#########################################%s\n", red, noColour)
+	fmt.Fprintf(os.Stderr, "%s#                                       #%s\n", red, noColour)
+	fmt.Fprintf(os.Stderr, "%s#             AZURE SECRETS             #%s\n", red, noColour)
+	fmt.Fprintf(os.Stderr, "%s#       IS IN OFFLINE TESTING MODE      #%s\n", red, noColour)
+	fmt.Fprintf(os.Stderr, "%s#        RETURNING RANDOM STRINGS       #%s\n", red, noColour)
+	fmt.Fprintf(os.Stderr, "%s#        INSTEAD OF REAL SECRETS!       #%s\n", red, noColour)
+	fmt.Fprintf(os.Stderr, "%s#                                       #%s\n", red, noColour)
+	fmt.Fprintf(os.Stderr, "%s#########################################%s\n", red, noColour)
+
+	secs, err := strconv.Atoi(os.Getenv(warnForSeconds))
+	if err == nil && secs > 0 {
+		time.Sleep(time.Second * time.Duration(secs))
+	}
+}
+
+func (kvc randomSecretClient) getSecret(_ context.Context, name string, version string) (*vaultSecret, error) {
+	kvc.warnUser()
+	if version == "" {
+		version = "offline"
+	}
+	var secret string
+	if kvc.seed != "" {
+		mac := kvc.hmac("secret:" + name + "@" + version)
+		chars := make([]byte, defaultPlaceholderLength)
+		for i := range chars {
+			chars[i] = defaultPlaceholderCharset[int(mac[i%len(mac)])%len(defaultPlaceholderCharset)]
+		}
+		secret = string(chars)
+	} else {
+		var err error
+		secret, err = randomString(defaultPlaceholderLength, defaultPlaceholderCharset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &vaultSecret{value: base64.StdEncoding.EncodeToString([]byte(secret)), version: version, enabled: true}, nil
+}
+
+// hmac returns the HMAC-SHA256 of the vault and message keyed with the seed
+func (kvc randomSecretClient) hmac(message string) []byte {
+	mac := hmac.New(sha256.New, []byte(kvc.seed))
+	mac.Write([]byte(kvc.vaultName + "/" + message))
+	return mac.Sum(nil)
+}
+
+// certificate returns a self signed certificate and private key for name. With a seed the certificate is the same
+// every time, it uses an Ed25519 key derived from the seed because Ed25519 signatures are deterministic.
+func (kvc randomSecretClient) certificate(name string) (string, string, error) {
+	if kvc.seed == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			return "", "", errors.Wrap(err, "Error generating private key")
+		}
+		return selfSignedCertificate(name, key, big.NewInt(rand.Int63()), time.Now(), time.Now().AddDate(1, 0, 0))
+	}
+	mac := kvc.hmac("certificate:" + name)
+	key := ed25519.NewKeyFromSeed(mac)
+	serial := new(big.Int).SetBytes(mac[:8])
+	notBefore := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return selfSignedCertificate(name, key, serial, notBefore, notBefore.AddDate(100, 0, 0))
+}
+
+// selfSignedCertificate returns a self signed certificate for commonName and its private key, in PEM format
+func selfSignedCertificate(commonName string, key crypto.Signer, serial *big.Int, notBefore time.Time, notAfter time.Time) (string, string, error) {
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Error creating certificate")
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Error encoding private key")
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})), nil
+}
+
+// fixtureFile is the format of a fixtures file. Secrets are read from the vault's own secrets and then from the top
+// level secrets, which are shared by every vault.
+type fixtureFile struct {
+	Vaults  map[string]fixtureVault  `json:"vaults,omitempty" yaml:"vaults,omitempty"`
+	Secrets map[string]fixtureSecret `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+}
+
+type fixtureVault struct {
+	Secrets map[string]fixtureSecret `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+}
+
+// fixtureSecret is either the value of a secret or an object with its value, older versions and attributes.
+// contentType is accepted so that fixtures can mirror Key Vault but, as with real secrets, it is not used.
+type fixtureSecret struct {
+	Value       string            `json:"value" yaml:"value"`
+	Version     string            `json:"version,omitempty" yaml:"version,omitempty"`
+	Versions    map[string]string `json:"versions,omitempty" yaml:"versions,omitempty"`
+	ContentType string            `json:"contentType,omitempty" yaml:"contentType,omitempty"`
+	Enabled     *bool             `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+}
+
+func (s *fixtureSecret) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '{' {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			// Numbers and booleans are used as they are written
+			value = string(data)
+		}
+		*s = fixtureSecret{Value: value}
+		return nil
+	}
+	type plain fixtureSecret
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// fixtureLatestVersion is the version of fixtures that do not set one
+const fixtureLatestVersion = "fixture"
+
+// fixtureClient reads secrets from a YAML or JSON fixtures file, or every .yaml, .yml and .json file in a directory,
+// instead of from Key Vault
+type fixtureClient struct {
+	vaultName string
+	path      string
+	secrets   map[string]fixtureSecret
+}
+
+// newFixtureClient reads the fixtures at path. Secrets are read from the vaults section named section first and then
+// from the top level secrets.
+func newFixtureClient(vaultName string, path string, section string) (iKvClient, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading fixtures %s", path)
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading fixtures %s", path)
+		}
+		files = nil
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".yaml", ".yml", ".json":
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	shared := map[string]fixtureSecret{}
+	secrets := map[string]fixtureSecret{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading fixtures %s", file)
+		}
+		fixtures := fixtureFile{}
+		err = yaml.Unmarshal(data, &fixtures)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing fixtures %s", file)
+		}
+		for name, secret := range fixtures.Secrets {
+			shared[name] = secret
+		}
+		for name, secret := range fixtures.Vaults[section].Secrets {
+			secrets[name] = secret
+		}
+	}
+	for name, secret := range shared {
+		if _, ok := secrets[name]; !ok {
+			secrets[name] = secret
+		}
+	}
+	return fixtureClient{vaultName: vaultName, path: path, secrets: secrets}, nil
+}
+
+func (kvc fixtureClient) getSecret(_ context.Context, name string, version string) (*vaultSecret, error) {
+	secret, ok := kvc.secrets[name]
+	if !ok {
+		return nil, notFoundError{vault: kvc.vaultName, name: name, fixtures: kvc.path}
+	}
+	sec := vaultSecret{value: secret.Value, version: secret.Version, enabled: secret.Enabled == nil || *secret.Enabled}
+	if sec.version == "" {
+		sec.version = fixtureLatestVersion
+	}
+	if version != "" && version != sec.version {
+		value, ok := secret.Versions[version]
+		if !ok {
+			return nil, notFoundError{vault: kvc.vaultName, name: name + "@" + version, fixtures: kvc.path}
+		}
+		sec.value = value
+		sec.version = version
+	}
+	return &sec, nil
+}
+
+// cassette holds the responses that a recordingClient captured so that a replayClient can serve them without Azure.
+// Values are stored as they are, encrypted with AES-GCM or redacted.
+type cassette struct {
+	Interactions []cassetteInteraction `json:"interactions" yaml:"interactions"`
+	path         string
+	mode         string
+	values       string
+	key          []byte
+	redactor     *redactor
+	changed      bool
+	mutex        sync.Mutex
+}
+
+// cassetteInteraction is a request for a secret and the response to it
+type cassetteInteraction struct {
+	Vault         string `json:"vault" yaml:"vault"`
+	Name          string `json:"name" yaml:"name"`
+	Version       string `json:"version,omitempty" yaml:"version,omitempty"`
+	Value         string `json:"value,omitempty" yaml:"value,omitempty"`
+	Values        string `json:"values,omitempty" yaml:"values,omitempty"`
+	SecretVersion string `json:"secretVersion,omitempty" yaml:"secretVersion,omitempty"`
+	Enabled       bool   `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	NotFound      bool   `json:"notFound,omitempty" yaml:"notFound,omitempty"`
+	Error         string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func (i cassetteInteraction) id() string {
+	return secretRef{vault: i.Vault, name: i.Name, version: i.Version}.String()
+}
+
+// record adds the response to a request, replacing any earlier response to it
+func (c *cassette) record(vault string, name string, version string, sec *vaultSecret, err error) error {
+	interaction := cassetteInteraction{Vault: vault, Name: name, Version: version}
+	if isNotFound(err) {
+		interaction.NotFound = true
+	} else if err != nil {
+		interaction.Error = c.redactor.redact(err.Error())
+	} else {
+		value, err := c.encode(sec.value)
+		if err != nil {
+			return err
+		}
+		interaction.Value, interaction.Values = value, c.values
+		interaction.SecretVersion, interaction.Enabled = sec.version, sec.enabled
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := range c.Interactions {
+		if c.Interactions[i].id() == interaction.id() {
+			c.Interactions[i] = interaction
+			c.changed = true
+			return nil
+		}
+	}
+	c.Interactions = append(c.Interactions, interaction)
+	c.changed = true
+	return nil
+}
+
+// replay returns the recorded response to a request
+func (c *cassette) replay(vault string, name string, version string) (*vaultSecret, error) {
+	ref := secretRef{vault: vault, name: name, version: version}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, interaction := range c.Interactions {
+		if interaction.id() != ref.String() {
+			continue
+		}
+		if interaction.NotFound {
+			return nil, notFoundError{vault: vault, name: name}
+		}
+		if interaction.Error != "" {
+			return nil, errors.New(interaction.Error)
+		}
+		value, err := c.decode(interaction.Value, interaction.Values)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not replay secret '%s' from vault '%s'", ref.id(), vault)
+		}
+		return &vaultSecret{value: value, version: interaction.SecretVersion, enabled: interaction.Enabled}, nil
+	}
+	return nil, errors.Errorf("Secret '%s' from vault '%s' is not in the cassette %s. Set %s=%s to record it", ref.id(), vault, c.path, cassetteModeEnv, cassetteModeRecord)
+}
+
+func (c *cassette) encode(value string) (string, error) {
+	switch c.values {
+	case cassetteValuesPlain:
+		return value, nil
+	case cassetteValuesEncrypted:
+		gcm, err := c.cipher()
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(crand.Reader, nonce); err != nil {
+			return "", errors.Wrap(err, "Error generating nonce")
+		}
+		return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), nil)), nil
+	}
+	return redactValue(value), nil
+}
+
+func (c *cassette) decode(value string, values string) (string, error) {
+	if values != cassetteValuesEncrypted {
+		return value, nil
+	}
+	gcm, err := c.cipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("Encrypted value is not valid")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Errorf("Encrypted value could not be decrypted, check %s", cassetteKeyEnv)
+	}
+	return string(plain), nil
+}
+
+// cipher returns AES-256-GCM keyed with the SHA-256 of AZURE_SECRETS_CASSETTE_KEY
+func (c *cassette) cipher() (cipher.AEAD, error) {
+	if c.key == nil {
+		return nil, errors.Errorf("%s is not set", cassetteKeyEnv)
+	}
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// redactedValue replaces redacted values, and every string, number and boolean in redacted JSON values
+const redactedValue = "REDACTED"
+
+// redactValue replaces a secret's value so that it can be recorded. JSON objects and arrays keep their shape so that
+// paths and expand still work when they are replayed.
+func redactValue(value string) string {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		return redactedValue
+	}
+	var redact func(v interface{}) interface{}
+	redact = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k := range v {
+				v[k] = redact(v[k])
+			}
+			return v
+		case []interface{}:
+			for i := range v {
+				v[i] = redact(v[i])
+			}
+			return v
+		}
+		return redactedValue
+	}
+	switch parsed.(type) {
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(redact(parsed))
+		if err == nil {
+			return string(data)
+		}
+	}
+	return redactedValue
+}
+
+// recordingClient records every response from another client in a cassette
+type recordingClient struct {
+	client    iKvClient
+	vaultName string
+	cassette  *cassette
+}
+
+func (kvc recordingClient) getSecret(ctx context.Context, name string, version string) (*vaultSecret, error) {
+	sec, err := kvc.client.getSecret(ctx, name, version)
+	if ctx.Err() != nil {
+		return sec, err
+	}
+	if recordErr := kvc.cassette.record(kvc.vaultName, name, version, sec, err); recordErr != nil {
+		return nil, recordErr
+	}
+	return sec, err
+}
+
+// replayClient serves the responses that were recorded in a cassette
+type replayClient struct {
+	vaultName string
+	cassette  *cassette
+}
+
+func (kvc replayClient) getSecret(_ context.Context, name string, version string) (*vaultSecret, error) {
+	return kvc.cassette.replay(kvc.vaultName, name, version)
+}
+
+// Kustomize plugins don't seem to support DI'ing mocks :(
+type testClient struct {
+	vaultName string
+}
+
+// testLatestVersion is the version ID that the test client reports for the latest version of every secret
+const testLatestVersion = "latest"
+
+func (kvc testClient) getSecret(ctx context.Context, name string, version string) (*vaultSecret, error) {
+	var val string
+	if version == "" {
+		version = testLatestVersion
+	}
 	if name == "ERR" {
 		return nil, errors.Errorf("test error")
+	} else if strings.HasPrefix(name, "MISSING") {
+		return nil, notFoundError{vault: kvc.vaultName, name: name}
+	} else if name == "LEAKY" {
+		// Like the SDK's errors when it can't unmarshal a response
+		return nil, errors.Errorf(`test error unmarshalling JSON = '{"value": "%s", "id": "%s"}'`, kvc.testSecretValue(name, version), name)
 	} else if name == "RND" {
 		val = fmt.Sprintf("%d", rand.Int63())
+	} else if name == "JSON" {
+		val = `{"host": "db.example.com", "port": 5432, "tags": ["a", "b"], "nested": {"key.with.dots": true}}`
+	} else if name == "DOTENV" {
+		val = "# App config\nexport HOST=db.example.com\nPORT=5432\nGREETING=\"Hello\\nWorld\"\nQUOTED='a b'\n"
+	} else if name == "PROPERTIES" {
+		val = "! App config\nhost = db.example.com\nport:5432\ngreeting Hello \\\n  World\n"
+	} else if name == "YAML" {
+		val = "host: db.example.com\nport: 5432\ntags:\n- a\n- b\n"
+	} else if name == "CERT" {
+		val = testCertificatePFX
+	} else if name == "PEMCERT" {
+		crt, key, _ := certificateToPEM(testCertificatePFX)
+		val = key + crt
+	} else if name == "ONELINEPEM" {
+		val = `-----BEGIN TEST----- U2VjcmV0IHZhbHVl IGZvciBQRU0= -----END TEST-----\n`
 	} else if strings.HasPrefix(name, "B64") {
-		val = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("Secret value for %s", name[3:])))
+		val = base64.StdEncoding.EncodeToString([]byte(kvc.testSecretValue(name[3:], version)))
+	} else if strings.HasPrefix(name, "HEX") {
+		val = hex.EncodeToString([]byte(kvc.testSecretValue(name[3:], version)))
+	} else if strings.HasPrefix(name, "GZ") {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(kvc.testSecretValue(name[2:], version)))
+		w.Close()
+		val = base64.StdEncoding.EncodeToString(buf.Bytes())
+	} else if strings.HasPrefix(name, "PADDED") {
+		val = "  " + kvc.testSecretValue(name[6:], version) + "\n"
 	} else {
-		val = fmt.Sprintf("Secret value for %s", name)
+		val = kvc.testSecretValue(name, version)
+	}
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &vaultSecret{value: val, version: version, enabled: true}, nil
+}
+
+func (kvc testClient) testSecretValue(name string, version string) string {
+	val := fmt.Sprintf("Secret value for %s", name)
+	if version != testLatestVersion {
+		val += fmt.Sprintf(" version %s", version)
 	}
-	time.Sleep(time.Second)
-	return &val, nil
+	if kvc.vaultName != testVaultName {
+		val += fmt.Sprintf(" from %s", kvc.vaultName)
+	}
+	return val
 }
+
+// testCertificatePFX is a base64 encoded PFX file containing a certificate for test.example.com, its EC private key
+// and the self signed "Test CA" certificate that issued it
+const testCertificatePFX = "MIIE2gIBAzCCBKAGCSqGSIb3DQEHAaCCBJEEggSNMIIEiTCCA38GCSqGSIb3DQEHBqCCA3AwggNsAgEAMIIDZQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQYwDgQI7DQkQhJHfeQCAggAgIIDOLDZvxeetlv9N347zVJ5F9UY7AthaH52vH8TycO4CpvXnGNtG2lhLJgiFG+XOVlkKl1t8rMJf3+rwNRFXK9OvNPbauK4NW2818L68E7rBvuLfgv4017Tzxe42+YooViWgfil9TklJtlvsB6zPqwMFx8cwx+CUdaVO1BmeRUFKHFdEErDy9yhDlO6ByAZd33hSVXOCOoIHchLk2zERWhWDDDlofi3qQSTEJlRL/pTk/3LkuZyVZ0Yll7cvVWb7DHruYPFQDmx7N+HTOkuxvx7iqOZNsb9iHdVb1VqKgi8jpuOMP74XSe4EOmQJO4/RtpFQR4zdXo782e8up8vYo1D6+W0+eHI7fspiSbC1c6qv2iTm+iAZgvzLNOfrJ7jws2OM4pNkp7T6d5mLfwqO8sV1d1PnzqMN+abpyBqrFW12Xtsqpg9AklqcLQ99VkTubYV0Srd9y/+cl5jOGXGev5IJPZn/sI51DnQ0oy3Q7iZjOmwQwMac2MirBrqLQ2z4SZyRoOxd0cYDtjo2T/+jwcvFT7pTs8vM7lDQAT3g37cmV85dStSBtgf/Sit0/4fI0X4e1/HM1t8J8u/GE4MnSZMzsF8bRT/W2z2BRYo/yjGGhNJQEdObaZTiS/MfOL0cRC9mdzifiSNhhrKD9pIhzPe547XUhnp+W2yhyUMlsuTWlJqGqmVm+W2TvPDaUk4BDZy5CMz4rt8ZofumOa74rf0osmG8AIZCri5Elsom6hghwtQhTyAv7oxcXxqcsVAvB/sVOk6ToBi1eaLYy2XswArBaEtwBy4Ng7EbhIGevnUJ4nKSo0/QVJ75LkUhaXYs4NjdortR0bUf98RZ3O5HTiFWLGAY5LEYUslGohzdfP1HtPIj9p2kwFUXnB2iPHyD+OoPUXNimXmokQ66GhU19HTZ6LpTS4zPdSurBOUFJsNu7Qgjx3mPNeFrHJV1ZsTqyIcY3iK/w3u+wEa/RPCqo25d08cAGdhTiS5XNLTkAQQHJOnonE5lgfjHc9KDbG4lY2gp8DJRjZ6/83h8d4XrXZq8EZKSCAuNPJstRNJjYQppPcVHS/L9KYljsb0nuQpIGY/hZVN6ML9j/+YMIIBAgYJKoZIhvcNAQcBoIH0BIHxMIHuMIHrBgsqhkiG9w0BDAoBAqCBtDCBsTAcBgoqhkiG9w0BDAEDMA4ECIHCE1/OzOBXAgIIAASBkKXbeRay10k8ffZkxZwwLbwG286PwxrcR9ROEsxdza7XkZ9avYKmvmeCaUXLtk7Ixagv5AaJEdWtbd2BC7Igw8SKkm4qfdVECUxvvzG/psFsZObn2RaREKssy7o3ynxtgpvyIYIWk/Ouw28nyd9K83vrK96tXh0BpRJ+9H2amadvr9d/UwUStkrQeQ/KnxtygDElMCMGCSqGSIb3DQEJFTEWBBQFScDB02gg7o9mur/4AvdXE9WOXTAxMCEwCQYFKw4DAhoFAAQUy/4pH/juOJKSFl33r4mIH+5cYOEECGAM9NWCvKz7AgIIAA=="
@@ -2,17 +2,34 @@ package main_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
 	kusttest_test "sigs.k8s.io/kustomize/api/testutils/kusttest"
 	"sigs.k8s.io/yaml"
 )
@@ -108,6 +125,518 @@ type: Opaque
 `)
 }
 
+func TestAzureSecrets_PinnedVersions(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+
+	result := th.LoadAndRunGenerator(
+		`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  namespace: test-ns
+  keys:
+  - LATESTKey=FOO
+  - V1Key=FOO@v1
+  - V2Key=FOO@v2
+  - V1AgainKey=FOO@v1`)
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  LATESTKey: `+fooSecret+`
+  V1AgainKey: `+encode("Secret value for FOO version v1")+`
+  V1Key: `+encode("Secret value for FOO version v1")+`
+  V2Key: `+encode("Secret value for FOO version v2")+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: test-ns
+type: Opaque
+`)
+}
+
+func TestAzureSecrets_MultipleVaults(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+
+	result := th.LoadAndRunGenerator(
+		`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  namespace: test-ns
+  keys:
+  - FOOKey=FOO
+  - SHAREDKey=__TESTING_AZURESECRETS__shared/FOO
+- name: tenant-secret
+  namespace: test-ns
+  vault: __TESTING_AZURESECRETS__tenant
+  keys:
+  - FOOKey=FOO@v1
+  - DEFAULTKey=__TESTING_AZURESECRETS__/FOO`)
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  FOOKey: `+fooSecret+`
+  SHAREDKey: `+encode("Secret value for FOO from __TESTING_AZURESECRETS__shared")+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: test-ns
+type: Opaque
+---
+apiVersion: v1
+data:
+  DEFAULTKey: `+fooSecret+`
+  FOOKey: `+encode("Secret value for FOO version v1 from __TESTING_AZURESECRETS__tenant")+`
+kind: Secret
+metadata:
+  name: tenant-secret
+  namespace: test-ns
+type: Opaque
+`)
+
+	err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  keys:
+  - FOOKey=FOO
+  - ERRKey=__TESTING_AZURESECRETS__tenant/ERR`)
+	if !strings.Contains(err.Error(), "from vault '__TESTING_AZURESECRETS__tenant'") {
+		t.Errorf("Expected error to name the vault, got %v", err)
+	}
+}
+
+// testConfig returns a generator named default-name with settings (vault etc.) and a secret named test-secret with
+// keys, which are indented YAML list items
+func testConfig(settings string, keys string) string {
+	return `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+` + settings + `
+secrets:
+- name: test-secret
+  keys:
+` + keys
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "azure-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func errorFromLoadAndRunGenerator(th *kusttest_test.HarnessEnhanced, config string) error {
+	th.WriteK("/", `generators:
+- azure_secrets.yaml`)
+	th.WriteF("/azure_secrets.yaml", config)
+	return th.RunWithErr("/", th.MakeOptionsPluginsEnabled())
+}
+
+// stderrFromLoadAndRunGenerator runs the generator and returns what it wrote to stderr and its error, if any
+func stderrFromLoadAndRunGenerator(t *testing.T, th *kusttest_test.HarnessEnhanced, config string) (string, error) {
+	var err error
+	th.WriteK("/", `generators:
+- azure_secrets.yaml`)
+	th.WriteF("/azure_secrets.yaml", config)
+	options := th.MakeOptionsPluginsEnabled()
+	stderr := captureStderr(t, func() {
+		_, err = krusty.MakeKustomizer(th.GetFSys(), &options).Run("/")
+	})
+	return stderr, err
+}
+
+func TestAzureSecrets_LockFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	lockFile := filepath.Join(dir, "azure_secrets.lock.yaml")
+	config := func(mode string) string {
+		return testConfig("vault: __TESTING_AZURESECRETS__\nlockFile: "+lockFile+"\nlockMode: "+mode, "  - FOOKey=FOO\n  - BARKey=BAR@v3")
+	}
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+
+	err := errorFromLoadAndRunGenerator(th, config("locked"))
+	if !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected missing lock file error, got %v", err)
+	}
+
+	th.LoadAndRunGenerator(config("update"))
+	lock, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLock := `secrets:
+- name: FOO
+  vault: __TESTING_AZURESECRETS__
+  version: latest
+`
+	if string(lock) != expectedLock {
+		t.Errorf("Expected lock file:\n%s\ngot:\n%s", expectedLock, string(lock))
+	}
+
+	err = ioutil.WriteFile(lockFile, []byte(strings.Replace(expectedLock, "latest", "v1", 1)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := th.LoadAndRunGenerator(config("locked"))
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  BARKey: `+encode("Secret value for BAR version v3")+`
+  FOOKey: `+encode("Secret value for FOO version v1")+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: default-ns
+type: Opaque
+`)
+
+	err = ioutil.WriteFile(lockFile, []byte("secrets: []\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = errorFromLoadAndRunGenerator(th, config("locked"))
+	if !strings.Contains(err.Error(), "is not in the lock file") {
+		t.Errorf("Expected missing lock entry error, got %v", err)
+	}
+
+	// Versions made up when testing offline are never written to the lock file
+	offlineLock := strings.Replace(expectedLock, "latest", "abc123", 1)
+	err = ioutil.WriteFile(lockFile, []byte(offlineLock), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("AZURE_SECRETS_OFFLINE_TESTING_MODE", "1")
+	th.LoadAndRunGenerator(config("update"))
+	os.Unsetenv("AZURE_SECRETS_OFFLINE_TESTING_MODE")
+	lock, err = ioutil.ReadFile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(lock) != offlineLock {
+		t.Errorf("Expected the lock file to be unchanged after an offline update, got:\n%s", string(lock))
+	}
+}
+
+func TestAzureSecrets_SharedLockFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	lockFile := filepath.Join(dir, "azure_secrets.lock.yaml")
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	generator := `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: %s
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+lockFile: ` + lockFile + `
+secrets:
+- name: %s
+  keys:
+  - KEY=%s`
+
+	os.Setenv("AZURE_SECRETS_LOCK_MODE", "update")
+	th.LoadAndRunGenerator(fmt.Sprintf(generator, "a", "secret-a", "FOO"))
+	th.LoadAndRunGenerator(fmt.Sprintf(generator, "b", "secret-b", "BAR"))
+	os.Unsetenv("AZURE_SECRETS_LOCK_MODE")
+	lock, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLock := `secrets:
+- name: BAR
+  vault: __TESTING_AZURESECRETS__
+  version: latest
+- name: FOO
+  vault: __TESTING_AZURESECRETS__
+  version: latest
+`
+	if string(lock) != expectedLock {
+		t.Errorf("Expected lock file:\n%s\ngot:\n%s", expectedLock, string(lock))
+	}
+
+	th.LoadAndRunGenerator(fmt.Sprintf(generator, "a", "secret-a", "FOO"))
+	th.LoadAndRunGenerator(fmt.Sprintf(generator, "b", "secret-b", "BAR"))
+}
+
+func TestAzureSecrets_InvalidRetryPolicy(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	config := `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: __TESTING_AZURESECRETS__
+retry:
+  %s
+secrets:
+- name: test-secret
+  keys:
+  - FOOKey=FOO`
+
+	err := errorFromLoadAndRunGenerator(th, fmt.Sprintf(config, "maxAttempts: 0"))
+	if !strings.Contains(err.Error(), "Invalid retry maxAttempts 0") {
+		t.Errorf("Expected invalid maxAttempts error, got %v", err)
+	}
+	err = errorFromLoadAndRunGenerator(th, fmt.Sprintf(config, "baseDelay: 1m"))
+	if !strings.Contains(err.Error(), "Invalid retry delays") {
+		t.Errorf("Expected invalid delays error, got %v", err)
+	}
+}
+
+func TestAzureSecrets_Retry(t *testing.T) {
+	requests := map[string]int{}
+	server, _ := newTestVaultServer(func(w http.ResponseWriter, r *http.Request, attempt int) {
+		requests[r.URL.Path] = attempt
+		switch r.URL.Path {
+		case "/myvault/secrets/SECONDS/":
+			if attempt == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		case "/myvault/secrets/DATE/":
+			if attempt == 1 {
+				w.Header().Set("Retry-After", time.Now().Add(2*time.Second).UTC().Format(http.TimeFormat))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/myvault/secrets/CAPPED/":
+			if attempt == 1 {
+				w.Header().Set("Retry-After", "3600")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		case "/myvault/secrets/UNAVAILABLE/":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case "/myvault/secrets/FORBIDDEN/":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"code":"Forbidden","message":"Forbidden by test"}}`))
+			return
+		}
+		fmt.Fprintf(w, `{"value":"Secret value","id":"https://%s%sv1","attributes":{"enabled":true}}`, r.Host, r.URL.Path)
+	})
+	defer server.Close()
+	settings := `vault: myvault
+vaultURL: ` + server.URL + `/{vault}
+auth:
+  type: managedIdentity
+  identityEndpoint: ` + server.URL + `/metadata/identity/oauth2/token
+retry:
+  baseDelay: 1ms
+  maxDelay: 3s
+  maxAttempts: 3`
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+
+	tests := []struct {
+		name     string
+		attempts int
+		min      time.Duration
+		max      time.Duration
+		err      string
+	}{
+		{name: "SECONDS", attempts: 2, min: time.Second, max: 3 * time.Second},
+		{name: "DATE", attempts: 2, min: time.Second, max: 3 * time.Second},
+		{name: "CAPPED", attempts: 2, min: 3 * time.Second, max: 5 * time.Second},
+		{name: "UNAVAILABLE", attempts: 3, max: time.Second, err: "after 3 attempt(s)"},
+		{name: "FORBIDDEN", attempts: 1, max: time.Second, err: "after 1 attempt(s)"},
+	}
+	for _, test := range tests {
+		config := testConfig(settings, "  - KEY="+test.name)
+		start := time.Now()
+		if test.err == "" {
+			th.LoadAndRunGenerator(config)
+		} else if err := errorFromLoadAndRunGenerator(th, config); !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected '%s' reading %s, got %v", test.err, test.name, err)
+		}
+		if duration := time.Since(start); duration < test.min || duration > test.max {
+			t.Errorf("Expected reading %s to take between %v and %v, took %v", test.name, test.min, test.max, duration)
+		}
+		if requests["/myvault/secrets/"+test.name+"/"] != test.attempts {
+			t.Errorf("Expected %s to be read %d time(s), got %d", test.name, test.attempts, requests["/myvault/secrets/"+test.name+"/"])
+		}
+	}
+}
+
+func writeSelfSignedCertificate(t *testing.T, certPath string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "azure-secrets-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	if err := ioutil.WriteFile(certPath, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAzureSecrets_Auth(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("federated-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	writeSelfSignedCertificate(t, certFile)
+
+	// Stands in for IMDS and Azure AD, refusing every request so that we can check what was asked for
+	var requestPath string
+	var requestValues url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requestPath = r.URL.Path
+		requestValues = r.Form
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_request","error_description":"Refused by test"}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		auth           string
+		expectedPath   string
+		expectedValues map[string]string
+	}{
+		{
+			auth: `type: managedIdentity
+  clientId: my-client
+  identityEndpoint: ` + server.URL + `/metadata/identity/oauth2/token`,
+			expectedPath: "/metadata/identity/oauth2/token",
+			expectedValues: map[string]string{
+				"resource":  "https://vault.azure.net",
+				"client_id": "my-client",
+			},
+		},
+		{
+			auth: `type: workloadIdentity
+  tenantId: my-tenant
+  clientId: my-client
+  tokenFile: ` + tokenFile + `
+  authorityHost: ` + server.URL,
+			expectedPath: "/my-tenant/oauth2/token",
+			expectedValues: map[string]string{
+				"resource":              "https://vault.azure.net",
+				"client_id":             "my-client",
+				"client_assertion":      "federated-token",
+				"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+			},
+		},
+		{
+			auth: `type: clientCertificate
+  tenantId: my-tenant
+  clientId: my-client
+  certificatePath: ` + certFile + `
+  authorityHost: ` + server.URL,
+			expectedPath: "/my-tenant/oauth2/token",
+			expectedValues: map[string]string{
+				"resource":              "https://vault.azure.net",
+				"client_id":             "my-client",
+				"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+			},
+		},
+	}
+
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	for _, test := range tests {
+		err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: myvault
+auth:
+  `+test.auth+`
+secrets:
+- name: test-secret
+  keys:
+  - FOOKey=FOO`)
+		if !strings.Contains(err.Error(), "Unable to get a token") || !strings.Contains(err.Error(), "Refused by test") {
+			t.Errorf("Expected token error, got %v", err)
+		}
+		if requestPath != test.expectedPath {
+			t.Errorf("Expected token request to %s, got %s", test.expectedPath, requestPath)
+		}
+		for k, v := range test.expectedValues {
+			if requestValues.Get(k) != v {
+				t.Errorf("Expected %s to be '%s' in token request, got '%s'", k, v, requestValues.Get(k))
+			}
+		}
+	}
+}
+
+func TestAzureSecrets_AzureCliAuth(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fakeAz := `#!/bin/sh
+echo "$@" > "$(dirname "$0")/args"
+echo "ERROR: Please run 'az login' to setup account." >&2
+exit 1
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "az"), []byte(fakeAz), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: myvault
+auth:
+  type: azureCli
+secrets:
+- name: test-secret
+  keys:
+  - FOOKey=FOO`)
+	if !strings.Contains(err.Error(), "Please run 'az login'") {
+		t.Errorf("Expected the Azure CLI error, got %v", err)
+	}
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(args) != "account get-access-token --resource https://vault.azure.net --output json\n" {
+		t.Errorf("Unexpected Azure CLI arguments %s", string(args))
+	}
+}
+
 func TestAzureSecrets_QueryVaultOncePerSecret(t *testing.T) {
 	th := kusttest_test.MakeEnhancedHarness(t).
 		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
@@ -140,25 +669,13 @@ secrets:
 }
 
 func TestAzureSecrets_OfflineTesting(t *testing.T) {
-	testAzureSecrets_OfflineTesting(t, "", 10, 15)
-}
-
-func TestAzureSecrets_OfflineTestingCustomDelay(t *testing.T) {
-	testAzureSecrets_OfflineTesting(t, "1", 2, 5)
-}
-
-func testAzureSecrets_OfflineTesting(t *testing.T, pauseForSecs string, minDuration float64, maxDuration float64) {
 	offlineTestingMode := "AZURE_SECRETS_OFFLINE_TESTING_MODE"
-	warnForSeconds := "AZURE_SECRETS_OFFLINE_TESTING_MODE_WARN_SECONDS"
 	os.Setenv(offlineTestingMode, "1")
-	os.Setenv(warnForSeconds, pauseForSecs)
-	start := time.Now()
 	th := kusttest_test.MakeEnhancedHarness(t).
 		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
 	result1 := th.LoadAndRunGenerator(simpleTestInput)
 	result2 := th.LoadAndRunGenerator(simpleTestInput)
 	os.Setenv(offlineTestingMode, "")
-	os.Setenv(warnForSeconds, "")
 
 	bResult1, err := result1.AsYaml()
 	if err != nil {
@@ -171,14 +688,8 @@ func testAzureSecrets_OfflineTesting(t *testing.T, pauseForSecs string, minDurat
 	if bytes.Compare(bResult1, bResult2) == 0 {
 		t.Errorf("Returned the same result twice. When %s is set random results should be returned", offlineTestingMode)
 	}
-
-	durationSecs := time.Since(start).Seconds()
-	if durationSecs < minDuration && durationSecs > maxDuration {
-		desiredDuration, e := strconv.Atoi(pauseForSecs)
-		if e != nil {
-			desiredDuration = 5
-		}
-		t.Errorf("When %s is set the user should be told and the plugin should pause for %d secs not %d", offlineTestingMode, desiredDuration*2, int(durationSecs))
+	if count := strings.Count(string(bResult1), "azure-secrets/offline: \"true\""); count != 3 {
+		t.Errorf("Expected every generated secret to have the offline annotation, got:\n%s", bResult1)
 	}
 
 	os.Setenv(offlineTestingMode, "1")
@@ -191,6 +702,74 @@ func testAzureSecrets_OfflineTesting(t *testing.T, pauseForSecs string, minDurat
 
 }
 
+// The warning is only printed once per process and the plugin stays loaded for the rest of the tests, so the builds
+// are run in a new test process
+func TestAzureSecrets_OfflineTestingCustomDelay(t *testing.T) {
+	if os.Getenv("AZURE_SECRETS_TEST_SUBPROCESS") != "" {
+		th := kusttest_test.MakeEnhancedHarness(t).
+			BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+		start := time.Now()
+		th.LoadAndRunGenerator(simpleTestInput)
+		th.LoadAndRunGenerator(simpleTestInput)
+		fmt.Printf("duration=%f\n", time.Since(start).Seconds())
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAzureSecrets_OfflineTestingCustomDelay$")
+	cmd.Env = append(os.Environ(),
+		"AZURE_SECRETS_TEST_SUBPROCESS=1",
+		"AZURE_SECRETS_OFFLINE_TESTING_MODE=1",
+		"AZURE_SECRETS_OFFLINE_TESTING_MODE_WARN_SECONDS=2")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Test process failed: %v\n%s\n%s", err, stdout.String(), stderr.String())
+	}
+
+	if count := strings.Count(stderr.String(), "IS IN OFFLINE TESTING MODE"); count != 1 {
+		t.Errorf("Expected the warning to be printed once across 2 builds, got %d times:\n%s", count, stderr.String())
+	}
+	match := regexp.MustCompile(`duration=([0-9.]+)`).FindStringSubmatch(stdout.String())
+	if match == nil {
+		t.Fatalf("Expected the test process to print its duration, got %s", stdout.String())
+	}
+	duration, _ := strconv.ParseFloat(match[1], 64)
+	if duration < 2 || duration > 6 {
+		t.Errorf("Expected the plugin to pause once for 2 secs, took %.1f secs", duration)
+	}
+}
+
+func TestAzureSecrets_OfflineTestingRefuseInCI(t *testing.T) {
+	ci, ciSet := os.LookupEnv("CI")
+	defer func() {
+		if ciSet {
+			os.Setenv("CI", ci)
+		} else {
+			os.Unsetenv("CI")
+		}
+	}()
+	os.Setenv("AZURE_SECRETS_OFFLINE_TESTING_MODE", "1")
+	os.Setenv("AZURE_SECRETS_OFFLINE_TESTING_REFUSE_IN_CI", "1")
+	defer os.Unsetenv("AZURE_SECRETS_OFFLINE_TESTING_MODE")
+	defer os.Unsetenv("AZURE_SECRETS_OFFLINE_TESTING_REFUSE_IN_CI")
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+
+	for _, value := range []string{"", "true"} {
+		os.Setenv("CI", value)
+		err := errorFromLoadAndRunGenerator(th, simpleTestInput)
+		if !strings.Contains(err.Error(), "refusing to make up secrets") {
+			t.Errorf("Expected offline testing to be refused when CI is '%s', got %s", value, err)
+		}
+	}
+
+	os.Setenv("CI", "false")
+	yamlResult, _ := th.LoadAndRunGenerator(simpleTestInput).AsYaml()
+	if !strings.Contains(string(yamlResult), "azure-secrets/offline") {
+		t.Errorf("Expected offline secrets when CI is 'false', got %s", yamlResult)
+	}
+}
+
 func TestAzureSecrets_OutputAsConfigMap(t *testing.T) {
 	th := kusttest_test.MakeEnhancedHarness(t).
 		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
@@ -267,53 +846,1322 @@ func TestAzureSecrets_OnErrorWarnAndExclude(t *testing.T) {
 	}
 }
 
-// func TestAzureSecrets_RunInParallel(t *testing.T) {
-// 	// The test implementation takes ~1000ms to get a secret
-// 	th := kusttest_test.MakeEnhancedHarness(t).
-// 		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
-// 	start := time.Now()
-// 	th.LoadAndRunGenerator(
-//     `apiVersion: devjoes/v1
-// kind: AzureSecrets
-// metadata:
-//   name: default-name
-//   namespace: default-ns
-// vault: __TESTING_AZURESECRETS__
-// secrets:
-// - name: test-secret1
-//   namespace: test-ns
-//   keys:
-//   - FOOKey=foo`)
-// 	singleDuration := time.Since(start)
-// 	start = time.Now()
-// 	th.LoadAndRunGenerator(
-//     `apiVersion: devjoes/v1
-// kind: AzureSecrets
-// metadata:
-//   name: default-name
-// vault: __TESTING_AZURESECRETS__
-// secrets:
-// - name: test-secret1
-//   namespace: test-ns
-//   keys:
-//   - FOOKey=foo1
-//   - BARKey=bar1
-//   - BAZKey=baz1
-// - name: test-secret2
-//   namespace: test-ns
-//   keys:
-//   - FOOKey=foo2
-//   - BARKey=bar2
-//   - BAZKey=baz2
-// - name: test-secret3
-//   namespace: test-ns
-//   keys:
-//   - FOOKey=foo3
-//   - BARKey=bar3
-//   - BAZKey=baz3`)
-// 	nineDuration := time.Since(start)
-
-// 	if nineDuration > singleDuration*2 {
-// 		t.Errorf("Retrieving 9 secrets took %f times linger than retrieving a single secret - expected <2 times", float64(nineDuration.Milliseconds())/float64(singleDuration.Milliseconds()))
-// 	}
-// }
+func TestAzureSecrets_RunInParallel(t *testing.T) {
+	// The test implementation takes ~1000ms to get a secret
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	start := time.Now()
+	th.LoadAndRunGenerator(
+		`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret1
+  namespace: test-ns
+  keys:
+  - FOOKey=foo`)
+	singleDuration := time.Since(start)
+	start = time.Now()
+	th.LoadAndRunGenerator(
+		`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: __TESTING_AZURESECRETS__
+parallelism: 10
+secrets:
+- name: test-secret1
+  namespace: test-ns
+  keys:
+  - FOOKey=foo1
+  - BARKey=bar1
+  - BAZKey=baz1
+- name: test-secret2
+  namespace: test-ns
+  keys:
+  - FOOKey=foo2
+  - BARKey=bar2
+  - BAZKey=baz2
+- name: test-secret3
+  namespace: test-ns
+  keys:
+  - FOOKey=foo3
+  - BARKey=bar3
+  - BAZKey=baz3`)
+	nineDuration := time.Since(start)
+
+	if nineDuration > singleDuration*2 {
+		t.Errorf("Retrieving 9 secrets took %f times linger than retrieving a single secret - expected <2 times", float64(nineDuration.Milliseconds())/float64(singleDuration.Milliseconds()))
+	}
+}
+
+func TestAzureSecrets_RunInParallelFailsFast(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	start := time.Now()
+	err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+parallelism: 2
+secrets:
+- name: test-secret1
+  namespace: test-ns
+  keys:
+  - ERRKey=ERR
+  - AKey=ZA
+  - BKey=ZB
+  - CKey=ZC`)
+	if !strings.Contains(err.Error(), "test error") {
+		t.Errorf("Expected the test error, got %v", err)
+	}
+	// The test implementation takes ~1000ms to get a secret, ZA should be cancelled as soon as ERR fails
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Reading secrets was not cancelled after the first error, took %v", time.Since(start))
+	}
+}
+
+// newTestVaultServer stands in for both IMDS and the Key Vault data plane. Authorized Key Vault requests are passed to
+// handler along with how many times their path has been requested, one at a time. The resource that the last token
+// was requested for is written to tokenResource.
+func newTestVaultServer(handler func(w http.ResponseWriter, r *http.Request, attempt int)) (server *httptest.Server, tokenResource *string) {
+	var mutex sync.Mutex
+	requests := map[string]int{}
+	tokenResource = new(string)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/metadata/identity/oauth2/token" {
+			*tokenResource = r.URL.Query().Get("resource")
+			fmt.Fprintf(w, `{"access_token":"test-token","expires_on":"%d","resource":"%s","token_type":"Bearer"}`,
+				time.Now().Add(time.Hour).Unix(), *tokenResource)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests[r.URL.Path]++
+		handler(w, r, requests[r.URL.Path])
+	}))
+	return server, tokenResource
+}
+
+func TestAzureSecrets_VaultURL(t *testing.T) {
+	requests := map[string]int{}
+	server, tokenResource := newTestVaultServer(func(w http.ResponseWriter, r *http.Request, attempt int) {
+		requests[r.URL.Path] = attempt
+		switch r.URL.Path {
+		case "/myvault/secrets/FOO/":
+			fmt.Fprintf(w, `{"value":"Secret value for FOO","id":"https://%s/myvault/secrets/FOO/v1","attributes":{"enabled":true}}`, r.Host)
+		case "/myvault/secrets/FLAKY/":
+			if attempt == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			fmt.Fprintf(w, `{"value":"Secret value for FLAKY","id":"https://%s/myvault/secrets/FLAKY/v3"}`, r.Host)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"SecretNotFound","message":"Not found by test"}}`))
+		}
+	})
+	defer server.Close()
+	config := `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: myvault
+vaultURL: ` + server.URL + `/{vault}
+cloud: china
+auth:
+  type: managedIdentity
+  identityEndpoint: ` + server.URL + `/metadata/identity/oauth2/token
+retry:
+  baseDelay: 1ms
+secrets:
+- name: test-secret
+  namespace: test-ns
+  keys:
+  - FOOKey=FOO
+  - FLAKYKey=FLAKY`
+
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	result := th.LoadAndRunGenerator(config)
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  FLAKYKey: `+encode("Secret value for FLAKY")+`
+  FOOKey: `+fooSecret+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: test-ns
+type: Opaque
+`)
+	if *tokenResource != "https://vault.azure.cn" {
+		t.Errorf("Expected a token for https://vault.azure.cn, got %s", *tokenResource)
+	}
+	if requests["/myvault/secrets/FLAKY/"] != 2 {
+		t.Errorf("Expected FLAKY to be read twice, got %d", requests["/myvault/secrets/FLAKY/"])
+	}
+
+	err := errorFromLoadAndRunGenerator(th, strings.Replace(config, "FLAKYKey=FLAKY", "MISSINGKey=MISSING", 1))
+	if err == nil || !strings.Contains(err.Error(), "after 1 attempt(s)") || !strings.Contains(err.Error(), "Not found by test") {
+		t.Errorf("Expected a single attempt to read MISSING, got %v", err)
+	}
+	if requests["/myvault/secrets/MISSING/"] != 1 {
+		t.Errorf("Expected MISSING to be read once, got %d", requests["/myvault/secrets/MISSING/"])
+	}
+}
+
+func TestAzureSecrets_Certificates(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	result := th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: pfx-secret
+  type: kubernetes.io/tls
+  certificate: CERT
+- name: pem-secret
+  certificate: PEMCERT
+  keys:
+  - ca.crt=FOO`)
+
+	resources := result.Resources()
+	if len(resources) != 2 {
+		t.Fatalf("Expected 2 secrets, got %d", len(resources))
+	}
+	for _, r := range resources {
+		yamlResult, err := r.AsYAML()
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret := v1.Secret{}
+		if err := yaml.Unmarshal(yamlResult, &secret); err != nil {
+			t.Fatalf("Failed to unmarshal %s %v", string(yamlResult), err)
+		}
+		if secret.Type != v1.SecretTypeTLS {
+			t.Errorf("Expected %s to be type %s, got %s", secret.Name, v1.SecretTypeTLS, secret.Type)
+		}
+
+		var certs []*x509.Certificate
+		for block, rest := pem.Decode(secret.Data[v1.TLSCertKey]); block != nil; block, rest = pem.Decode(rest) {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) != 2 || certs[0].Subject.CommonName != "test.example.com" || certs[1].Subject.CommonName != "Test CA" {
+			t.Errorf("Expected the leaf certificate followed by the CA in %s, got %s", secret.Name, string(secret.Data[v1.TLSCertKey]))
+			continue
+		}
+		block, _ := pem.Decode(secret.Data[v1.TLSPrivateKeyKey])
+		if block == nil || block.Type != "PRIVATE KEY" {
+			t.Fatalf("Expected a PKCS #8 private key in %s", secret.Name)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKey, _ := x509.MarshalPKIXPublicKey(key.(*ecdsa.PrivateKey).Public())
+		if !bytes.Equal(publicKey, certs[0].RawSubjectPublicKeyInfo) {
+			t.Errorf("Private key in %s does not match the leaf certificate", secret.Name)
+		}
+		if secret.Name == "pem-secret" && string(secret.Data["ca.crt"]) != "Secret value for FOO" {
+			t.Errorf("Expected ca.crt in %s, got %s", secret.Name, yamlResult)
+		}
+	}
+}
+
+func TestAzureSecrets_InvalidSecretTypes(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	tests := map[string]string{
+		"type: kubernetes.io/tls":                      "does not have a certificate",
+		"type: Opaque\n  certificate: CERT":            "has a certificate but is type Opaque",
+		"certificate: CERT\n  outputAsConfigMap: true": "can not be output as a ConfigMap",
+		"type: kubernetes.io/foo":                      "unsupported type",
+		"certificate: FOO":                             "Could not read certificate 'FOO'",
+		"type: kubernetes.io/dockerconfigjson\n  keys:\n  - registry=FOO\n  - username=FOO": "must have registry, username and password",
+		"type: kubernetes.io/dockerconfigjson\n  keys:\n  - server=FOO":                     "has key 'server'",
+		"type: kubernetes.io/basic-auth\n  keys:\n  - user=FOO":                             "must have a username or password key",
+		"type: kubernetes.io/ssh-auth\n  keys:\n  - key=FOO":                                "must have a ssh-privatekey key",
+		"type: kubernetes.io/service-account-token":                                         "must have the kubernetes.io/service-account.name annotation",
+		"type: example.com/custom\n  outputAsConfigMap: true":                               "can not be output as a ConfigMap",
+	}
+	for secret, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  `+secret)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' for %s, got %v", expected, secret, err)
+		}
+	}
+}
+
+func TestAzureSecrets_DockerConfigJSON(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	result := th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: pull-secret
+  type: kubernetes.io/dockerconfigjson
+  base64decode: true
+  keys:
+  - registry=B64REGISTRY
+  - username=B64USER
+  - password=B64PASSWORD
+  - email=B64EMAIL`)
+	auth := encode("Secret value for USER:Secret value for PASSWORD")
+	dockerConfig := `{"auths":{"Secret value for REGISTRY":{"username":"Secret value for USER","password":"Secret value for PASSWORD","email":"Secret value for EMAIL","auth":"` + auth + `"}}}`
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  .dockerconfigjson: `+encode(dockerConfig)+`
+kind: Secret
+metadata:
+  name: pull-secret
+  namespace: default-ns
+type: kubernetes.io/dockerconfigjson
+`)
+}
+
+func TestAzureSecrets_SecretTypesAndMetadata(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	result := th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: basic-auth
+  type: kubernetes.io/basic-auth
+  labels:
+    app: foo
+  annotations:
+    owner: team-foo
+  disableNameSuffixHash: true
+  keys:
+  - username=FOO
+  - password=BAR
+- name: custom
+  type: example.com/custom
+  keys:
+  - FOOKey=FOO`)
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  password: `+barSecret+`
+  username: `+fooSecret+`
+kind: Secret
+metadata:
+  annotations:
+    owner: team-foo
+  labels:
+    app: foo
+  name: basic-auth
+  namespace: default-ns
+type: kubernetes.io/basic-auth
+---
+apiVersion: v1
+data:
+  FOOKey: `+fooSecret+`
+kind: Secret
+metadata:
+  name: custom
+  namespace: default-ns
+type: example.com/custom
+`)
+	resources := result.Resources()
+	if resources[0].NeedHashSuffix() || !resources[1].NeedHashSuffix() {
+		t.Errorf("Expected only the custom secret to have a name suffix hash")
+	}
+}
+
+func TestAzureSecrets_JSONPath(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	result := th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  keys:
+  - HOST=JSON#$.host
+  - PORT=JSON#$.port
+  - TAG=JSON#$.tags[1]
+  - DOTS=JSON#$.nested['key.with.dots']
+  - NESTED=JSON#$.nested`)
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  DOTS: `+encode("true")+`
+  HOST: `+encode("db.example.com")+`
+  NESTED: `+encode(`{"key.with.dots":true}`)+`
+  PORT: `+encode("5432")+`
+  TAG: `+encode("b")+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: default-ns
+type: Opaque
+`)
+
+	tests := map[string]string{
+		"HOST=JSON#$.missing": "Could not read key 'HOST' from secret 'JSON' in vault '__TESTING_AZURESECRETS__': Path '$.missing' was not found",
+		"TAG=JSON#$.tags[2]":  "Path '$.tags[2]' was not found",
+		"HOST=FOO#$.host":     "Value is not JSON so path '$.host' can not be read",
+		"HOST=JSON#host":      "Path 'host' must start with $",
+		"HOST=JSON#$.tags[a]": "invalid index 'a'",
+	}
+	for key, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  keys:
+  - `+key)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' for %s, got %v", expected, key, err)
+		} else if strings.Contains(err.Error(), "Secret value for") || strings.Contains(err.Error(), "db.example.com") {
+			t.Errorf("Error for %s contains the value of the secret %v", key, err)
+		}
+	}
+}
+
+func TestAzureSecrets_Expand(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	result := th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: json
+  expand: JSON
+  prefix: DB_
+  exclude:
+  - nested
+- name: dotenv
+  expand: DOTENV
+  format: dotenv
+- name: properties
+  expand: PROPERTIES
+  format: properties
+  include:
+  - host
+  - g*
+- name: yaml
+  expand: YAML
+  format: yaml
+  keys:
+  - FOOKey=FOO`)
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  DB_host: `+encode("db.example.com")+`
+  DB_port: `+encode("5432")+`
+  DB_tags: `+encode(`["a","b"]`)+`
+kind: Secret
+metadata:
+  name: json
+  namespace: default-ns
+type: Opaque
+---
+apiVersion: v1
+data:
+  GREETING: `+encode("Hello\nWorld")+`
+  HOST: `+encode("db.example.com")+`
+  PORT: `+encode("5432")+`
+  QUOTED: `+encode("a b")+`
+kind: Secret
+metadata:
+  name: dotenv
+  namespace: default-ns
+type: Opaque
+---
+apiVersion: v1
+data:
+  greeting: `+encode("Hello World")+`
+  host: `+encode("db.example.com")+`
+kind: Secret
+metadata:
+  name: properties
+  namespace: default-ns
+type: Opaque
+---
+apiVersion: v1
+data:
+  FOOKey: `+fooSecret+`
+  host: `+encode("db.example.com")+`
+  port: `+encode("5432")+`
+  tags: `+encode(`["a","b"]`)+`
+kind: Secret
+metadata:
+  name: yaml
+  namespace: default-ns
+type: Opaque
+`)
+
+	tests := map[string]string{
+		"expand: FOO":                   "Could not expand secret 'FOO' from vault '__TESTING_AZURESECRETS__': Value is not a json object",
+		"expand: FOO\n  format: dotenv": "Line 1 is not in the form KEY=value",
+		"expand: FOO\n  format: toml":   "invalid format 'toml'",
+		"format: json":                  "nothing to expand",
+	}
+	for secret, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  `+secret)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' for %s, got %v", expected, secret, err)
+		} else if strings.Contains(err.Error(), "Secret value for") {
+			t.Errorf("Error for %s contains the value of the secret %v", secret, err)
+		}
+	}
+}
+
+func TestAzureSecrets_Templates(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	result := th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  keys:
+  - FOOKey=FOO
+  templates:
+    appsettings.json: |
+      {
+        "Foo": {{ secret "FOO" | json }},
+        "Host": {{ secret "JSON#$.host" | json }},
+        "Bar": "{{ secret "B64BAR" | b64dec }}"
+      }
+    application.properties: |
+      foo.encoded={{ b64enc (secret "FOO") }}
+      bar={{ secret "__TESTING_AZURESECRETS__/BAR@v1" }}
+    config.yaml: |
+      config:
+      {{ secret "YAML" | indent 2 }}`)
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  FOOKey: `+fooSecret+`
+  application.properties: `+encode("foo.encoded="+fooSecret+"\nbar=Secret value for BAR version v1\n")+`
+  appsettings.json: `+encode(`{
+  "Foo": "Secret value for FOO",
+  "Host": "db.example.com",
+  "Bar": "Secret value for BAR"
+}
+`)+`
+  config.yaml: `+encode("config:\n  host: db.example.com\n  port: 5432\n  tags:\n  - a\n  - b\n  \n")+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: default-ns
+type: Opaque
+`)
+
+	tests := map[string]string{
+		`{{ secret "FOO" `:             "Secret 'test-secret' has an invalid template for key 'key': template: key:1: unclosed action",
+		`{{ secret .Name }}`:           "secret must be given the name of a vault secret as a string",
+		`{{ secret "JSON#host" }}`:     "Path 'host' must start with $",
+		`{{ secret "FOO" | b64dec }}`:  "Could not render the template for key 'key'",
+		`{{ secret "FOO" | unknown }}`: `function "unknown" not defined`,
+	}
+	for template, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  templates:
+    key: '`+template+`'`)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' for %s, got %v", expected, template, err)
+		} else if strings.Contains(err.Error(), "Secret value for") {
+			t.Errorf("Error for %s contains the value of the secret %v", template, err)
+		}
+	}
+
+	// Templates of secrets that can't be read get placeholders instead of being rendered
+	result = th.LoadAndRunGenerator(testConfig(`vault: __TESTING_AZURESECRETS__
+onError:
+  warn: true
+  placeholder:
+    strategy: sentinel
+    value: CHANGEME`, "  - FOOKey=FOO") + `
+  templates:
+    key: '{{ secret "ERR" | b64dec }}'`)
+	if yamlResult, _ := result.AsYaml(); !strings.Contains(string(yamlResult), "key: "+encode("CHANGEME")+"\n") {
+		t.Errorf("Expected a placeholder for the template, got %s", yamlResult)
+	}
+}
+
+func TestAzureSecrets_Transforms(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	result := th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  transforms:
+  - trim
+  keys:
+  - TRIM=PADDEDFOO
+  - HEX=HEXFOO|hexdecode
+  - GZIP=GZFOO|base64decode|gunzip
+  - B64=FOO|base64encode
+  - B64URL=FOO|base64urlencode
+  - ROUNDTRIP=FOO|base64urlencode|base64urldecode
+  - PEM=ONELINEPEM|pem
+  - JSON=JSON|jsonminify
+  - HOST=JSON#$.host|base64encode`)
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  B64: `+encode(fooSecret)+`
+  B64URL: `+encode(base64.URLEncoding.EncodeToString([]byte("Secret value for FOO")))+`
+  GZIP: `+fooSecret+`
+  HEX: `+fooSecret+`
+  HOST: `+encode(encode("db.example.com"))+`
+  JSON: `+encode(`{"host":"db.example.com","port":5432,"tags":["a","b"],"nested":{"key.with.dots":true}}`)+`
+  PEM: `+encode("-----BEGIN TEST-----\nU2VjcmV0IHZhbHVlIGZvciBQRU0=\n-----END TEST-----\n")+`
+  ROUNDTRIP: `+fooSecret+`
+  TRIM: `+fooSecret+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: default-ns
+type: Opaque
+`)
+
+	tests := map[string]string{
+		"keys:\n  - KEY=FOO|hexdecode":              "Could not apply transform 'hexdecode' to key 'KEY': Value is not hex encoded",
+		"keys:\n  - KEY=B64FOO|base64decode|gunzip": "Could not apply transform 'gunzip' to key 'KEY': Value is not gzip compressed",
+		"keys:\n  - KEY=FOO|pem":                    "Could not apply transform 'pem' to key 'KEY': Value does not contain any PEM blocks",
+		"base64decode: true\n  keys:\n  - KEY=FOO":  "Could not apply transform 'base64decode' to key 'KEY': Value is not base64 encoded",
+		"keys:\n  - KEY=FOO|rot13":                  "invalid transforms for key 'KEY': Unknown transform 'rot13'",
+		"transforms: [rot13]":                       "Secret 'test-secret' has invalid transforms: Unknown transform 'rot13'",
+	}
+	for secret, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+vault: __TESTING_AZURESECRETS__
+secrets:
+- name: test-secret
+  `+secret)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' for %s, got %v", expected, secret, err)
+		} else if strings.Contains(err.Error(), "Secret value for") {
+			t.Errorf("Error for %s contains the value of the secret %v", secret, err)
+		}
+	}
+}
+
+// captureStderr returns everything written to stderr by f
+func captureStderr(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		buf.ReadFrom(r)
+		output <- buf.String()
+	}()
+	defer func() {
+		os.Stderr = stderr
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+func TestAzureSecrets_NoSecretValuesInOutput(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	tests := []string{
+		"keys:\n  - KEY=FOO\n  - ERR=ERR",
+		"keys:\n  - KEY=FOO\n  - LEAKY=LEAKY",
+		"keys:\n  - KEY=FOO|hexdecode",
+		"keys:\n  - KEY=FOO#$.host",
+		"base64decode: true\n  keys:\n  - KEY=FOO",
+		"expand: FOO",
+		"certificate: FOO",
+		"templates:\n    key: '{{ secret \"FOO\" | b64dec }}'",
+		"templates:\n    key: '{{ secret \"FOO\" | indent \"FOO\" }}'",
+		"keys:\n  - KEY=FOO\n  - B64=B64FOO",
+	}
+	for _, onError := range []string{"warn: false", "warn: true"} {
+		for _, secret := range tests {
+			stderr, err := stderrFromLoadAndRunGenerator(t, th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+verbose: true
+onError:
+  `+onError+`
+secrets:
+- name: test-secret
+  `+secret)
+			output := stderr
+			if err != nil {
+				output += err.Error()
+			}
+			for _, value := range []string{"Secret value for", fooSecret} {
+				if strings.Contains(output, value) {
+					t.Errorf("Found '%s' in the output for %s with %s:\n%s", value, secret, onError, output)
+				}
+			}
+		}
+	}
+}
+
+func TestAzureSecrets_Logging(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	run := func(config string, env string) (string, error) {
+		if env != "" {
+			os.Setenv("AZURE_SECRETS_LOG_LEVEL", env)
+			defer os.Unsetenv("AZURE_SECRETS_LOG_LEVEL")
+		}
+		return stderrFromLoadAndRunGenerator(t, th, testConfig("vault: __TESTING_AZURESECRETS__\n"+config, "  - KEY=FOO"))
+	}
+
+	stderr, err := run("", "")
+	if err != nil || stderr != "" {
+		t.Errorf("Expected nothing to be logged by default, got %v %s", err, stderr)
+	}
+
+	stderr, err = run("verbose: true", "error")
+	if err != nil || stderr != "" {
+		t.Errorf("Expected the log level to be overridden by the env, got %v %s", err, stderr)
+	}
+
+	stderr, err = run("logLevel: info", "")
+	if err != nil || !strings.Contains(stderr, "Azure Secrets - INFO Generated secrets") ||
+		!strings.Contains(stderr, "generator=default-name secrets=1") || strings.Contains(stderr, "DEBUG") {
+		t.Errorf("Expected info messages, got %v %s", err, stderr)
+	}
+
+	stderr, err = run("logLevel: debug\nlogFormat: json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected JSON, got %s", line)
+		}
+		if entry["level"] == "debug" && entry["msg"] == "Read secret" {
+			found = entry["vault"] == "__TESTING_AZURESECRETS__" && entry["secret"] == "FOO" &&
+				entry["duration"] != nil && entry["time"] != nil
+		}
+	}
+	if !found {
+		t.Errorf("Expected a debug entry for reading FOO, got %s", stderr)
+	}
+
+	_, err = run("logLevel: loud", "")
+	if err == nil || !strings.Contains(err.Error(), "Invalid log level 'loud'") {
+		t.Errorf("Expected an invalid log level error, got %v", err)
+	}
+	_, err = run("logFormat: xml", "")
+	if err == nil || !strings.Contains(err.Error(), "Invalid log format 'xml'") {
+		t.Errorf("Expected an invalid log format error, got %v", err)
+	}
+}
+
+func TestAzureSecrets_OnErrorPerSecret(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	var result resmap.ResMap
+	stderr := captureStderr(t, func() {
+		result = th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+parallelism: 4
+secrets:
+- name: healthy
+  keys:
+  - FOOKey=FOO
+- name: patched
+  onError:
+    warn: true
+    patchMetadata:
+      annotations:
+        status: invalid
+  keys:
+  - FOOKey=FOO
+  - ERRKey=ERR
+- name: excluded
+  onError:
+    warn: true
+    exclude: true
+  keys:
+  - ERRKey=ERR`)
+	})
+	resources := result.Resources()
+	if len(resources) != 2 || resources[0].GetName() != "healthy" || resources[1].GetName() != "patched" {
+		t.Fatalf("Expected only the healthy and patched secrets, got %v", resources)
+	}
+	healthy, _ := resources[0].AsYAML()
+	if !strings.Contains(string(healthy), "FOOKey: "+fooSecret) || len(resources[0].GetAnnotations()) != 0 {
+		t.Errorf("Expected the healthy secret to be unaffected, got %s", healthy)
+	}
+	patched, _ := resources[1].AsYAML()
+	placeholder := regexp.MustCompile(`(?m)^  (FOO|ERR)Key: ` + encode("ERROR_")[:8])
+	if len(placeholder.FindAll(patched, -1)) != 2 || resources[1].GetAnnotations()["status"] != "invalid" {
+		t.Errorf("Expected every key in the patched secret to be a placeholder, got %s", patched)
+	}
+	for _, secret := range []string{"secret=patched", "secret=excluded"} {
+		if !strings.Contains(stderr, secret) {
+			t.Errorf("Expected a warning for %s, got %s", secret, stderr)
+		}
+	}
+
+	err := errorFromLoadAndRunGenerator(th, `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: __TESTING_AZURESECRETS__
+onError:
+  warn: true
+secrets:
+- name: patched
+  keys:
+  - ERRKey=ERR
+- name: strict
+  onError:
+    warn: false
+  keys:
+  - ERRKey=ERR`)
+	if !strings.Contains(err.Error(), "Error generating secrets for default-name") {
+		t.Errorf("Expected the secret's own onError to fail the generator, got %v", err)
+	}
+}
+
+func TestAzureSecrets_FallbacksAndOptionalKeys(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	config := func(keys string, extra string) string {
+		return testConfig("vault: __TESTING_AZURESECRETS__\n"+extra, keys)
+	}
+	result := th.LoadAndRunGenerator(config(`  - PRIMARY=FOO??BAR
+  - FALLBACK=MISSING1??BAR
+  - HOST=MISSING1#$.host??JSON#$.host
+  - DEFAULT=MISSING1??MISSING2??'dev default'
+  - OPTIONAL?=MISSING3
+  - PRESENT?=FOO`, ""))
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  DEFAULT: `+encode("dev default")+`
+  FALLBACK: `+barSecret+`
+  HOST: `+encode("db.example.com")+`
+  PRESENT: `+fooSecret+`
+  PRIMARY: `+fooSecret+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: default-ns
+type: Opaque
+`)
+
+	tests := map[string]string{
+		"  - KEY=ERR??BAR":             "test error",
+		"  - KEY=MISSING1":             "Secret 'MISSING1' was not found in vault '__TESTING_AZURESECRETS__'",
+		"  - KEY=MISSING1??MISSING2":   "Secret 'MISSING2' was not found",
+		"  - KEY=FOO??":                "Secret 'test-secret' is missing a vault secret name for key 'KEY'",
+		"  - KEY=MISSING1??FOO#$[":     "Secret 'test-secret' has an invalid path for key 'KEY'",
+		"  - KEY?=MISSING1\n  - B=ERR": "test error",
+	}
+	for keys, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, config(keys, ""))
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' for %s, got %v", expected, keys, err)
+		}
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	lockFile := filepath.Join(dir, "azure_secrets.lock.yaml")
+	keys := "  - KEY=MISSING1??BAR"
+	th.LoadAndRunGenerator(config(keys, "lockFile: "+lockFile+"\nlockMode: update"))
+	lock, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(lock), "missing: true\n  name: MISSING1") {
+		t.Errorf("Expected the missing secret to be recorded in the lock file, got:\n%s", lock)
+	}
+	result = th.LoadAndRunGenerator(config(keys, "lockFile: "+lockFile+"\nlockMode: locked"))
+	if yamlResult, _ := result.AsYaml(); !strings.Contains(string(yamlResult), "KEY: "+barSecret) {
+		t.Errorf("Expected the locked build to use the fallback, got %s", yamlResult)
+	}
+}
+
+func TestAzureSecrets_PlaceholderStrategies(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	config := func(extra string, placeholder string, keys string) string {
+		return testConfig("vault: __TESTING_AZURESECRETS__\n"+extra+"\nonError:\n  warn: true\n  placeholder:\n    "+placeholder, keys)
+	}
+	secretData := func(result resmap.ResMap) map[string]string {
+		yamlResult, err := result.AsYaml()
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret := v1.Secret{}
+		if err := yaml.Unmarshal(yamlResult, &secret); err != nil {
+			t.Fatalf("Failed to unmarshal %s %v", yamlResult, err)
+		}
+		data := map[string]string{}
+		for k, v := range secret.Data {
+			data[k] = string(v)
+		}
+		return data
+	}
+
+	data := secretData(th.LoadAndRunGenerator(config("", "strategy: random\n    length: 8\n    charset: ab", "  - A=ERR\n  - B=FOO")))
+	for _, k := range []string{"A", "B"} {
+		if !regexp.MustCompile(`^ERROR_[ab]{8}$`).MatchString(data[k]) {
+			t.Errorf("Expected a random placeholder for %s, got '%s'", k, data[k])
+		}
+	}
+	if data["A"] == data["B"] {
+		t.Errorf("Expected different placeholders for each key, got %v", data)
+	}
+
+	data = secretData(th.LoadAndRunGenerator(config("", "strategy: sentinel\n    value: CHANGEME\n    values:\n      B: other", "  - A=ERR\n  - B=FOO")))
+	if data["A"] != "CHANGEME" || data["B"] != "other" {
+		t.Errorf("Expected sentinel placeholders, got %v", data)
+	}
+
+	err := errorFromLoadAndRunGenerator(th, config("", "strategy: fail", "  - A=ERR"))
+	if !strings.Contains(err.Error(), "test error") {
+		t.Errorf("Expected the fail strategy to fail, got %v", err)
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	cacheFile := filepath.Join(dir, "azure_secrets.cache.yaml")
+	th.LoadAndRunGenerator(config("cacheFile: "+cacheFile, "strategy: previous", "  - A=FOO\n  - B=BAR"))
+	info, err := os.Stat(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the placeholder cache to only be readable by its owner, got %v", info.Mode())
+	}
+	data = secretData(th.LoadAndRunGenerator(config("cacheFile: "+cacheFile, "strategy: previous", "  - A=FOO\n  - B=ERR\n  - C=ERR")))
+	if data["A"] != "Secret value for FOO" || data["B"] != "Secret value for BAR" || !strings.HasPrefix(data["C"], "ERROR_") {
+		t.Errorf("Expected the previous values and a random placeholder for the new key, got %v", data)
+	}
+
+	tests := map[string]string{
+		config("", "strategy: bogus", "  - A=FOO"):    "Invalid placeholder strategy 'bogus'",
+		config("", "strategy: previous", "  - A=FOO"): "The previous placeholder strategy requires cacheFile to be set",
+		config("", "strategy: sentinel", "  - A=FOO"): "The sentinel placeholder strategy requires a value",
+		config("", "length: -1", "  - A=FOO"):         "Invalid placeholder length -1",
+	}
+	for c, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, c)
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s', got %v", expected, err)
+		}
+	}
+}
+
+func TestAzureSecrets_OfflineTestingSeed(t *testing.T) {
+	os.Setenv("AZURE_SECRETS_OFFLINE_TESTING_MODE", "1")
+	os.Setenv("AZURE_SECRETS_OFFLINE_TESTING_MODE_WARN_SECONDS", "0")
+	defer os.Unsetenv("AZURE_SECRETS_OFFLINE_TESTING_MODE")
+	defer os.Unsetenv("AZURE_SECRETS_OFFLINE_TESTING_MODE_WARN_SECONDS")
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	build := func(seed string, vault string) string {
+		result := th.LoadAndRunGenerator(`apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: ` + vault + `
+offlineSeed: "` + seed + `"
+secrets:
+- name: test-secret
+  keys:
+  - FOOKey=FOO
+  - BARKey=BAR
+- name: test-tls
+  certificate: CERT`)
+		yamlResult, err := result.AsYaml()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(yamlResult)
+	}
+
+	first := build("seed-a", "vault-a")
+	if second := build("seed-a", "vault-a"); first != second {
+		t.Errorf("Expected the same seed to give the same output, got:\n%s\nand:\n%s", first, second)
+	}
+	if other := build("seed-b", "vault-a"); other == first {
+		t.Errorf("Expected a different seed to give different output")
+	}
+	if other := build("seed-a", "vault-b"); other == first {
+		t.Errorf("Expected a different vault to give different output")
+	}
+	secret := v1.Secret{}
+	if err := yaml.Unmarshal([]byte(strings.Split(first, "\n---\n")[0]), &secret); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(secret.Data["FOOKey"], secret.Data["BARKey"]) {
+		t.Errorf("Expected different secrets to have different values, got %v", secret.Data)
+	}
+	if !strings.Contains(first, "tls.crt: ") {
+		t.Errorf("Expected a certificate, got %s", first)
+	}
+
+	os.Setenv("AZURE_SECRETS_OFFLINE_TESTING_SEED", "seed-a")
+	fromEnv := build("", "vault-a")
+	overridden := build("seed-b", "vault-a")
+	os.Unsetenv("AZURE_SECRETS_OFFLINE_TESTING_SEED")
+	if fromEnv != first {
+		t.Errorf("Expected the seed to be read from the environment")
+	}
+	if overridden != first {
+		t.Errorf("Expected the environment variable to override offlineSeed")
+	}
+	if build("", "vault-a") == build("", "vault-a") {
+		t.Errorf("Expected random output without a seed")
+	}
+}
+
+func TestAzureSecrets_Fixtures(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(dir, "fixtures.yaml"), []byte(`vaults:
+  my-vault:
+    secrets:
+      FOO: foo from my-vault
+secrets:
+  FOO: foo
+  BAR:
+    value: bar latest
+    version: v2
+    contentType: text/plain
+    versions:
+      v1: bar v1
+  PORT: 5432
+  DISABLED:
+    value: disabled
+    enabled: false
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "more.json"), []byte(`{"secrets": {"JSON": "from json"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	config := func(vault string, keys string) string {
+		return testConfig("vault: "+vault, keys)
+	}
+
+	os.Setenv("AZURE_SECRETS_FIXTURES", dir)
+	result := th.LoadAndRunGenerator(config("my-vault", `  - FOO=FOO
+  - SHARED=other-vault/FOO
+  - BAR=BAR
+  - BARV1=BAR@v1
+  - PORT=PORT
+  - JSON=JSON
+  - FALLBACK=MISSING??JSON`))
+	os.Unsetenv("AZURE_SECRETS_FIXTURES")
+	th.AssertActualEqualsExpected(result, `apiVersion: v1
+data:
+  BAR: `+encode("bar latest")+`
+  BARV1: `+encode("bar v1")+`
+  FALLBACK: `+encode("from json")+`
+  FOO: `+encode("foo from my-vault")+`
+  JSON: `+encode("from json")+`
+  PORT: `+encode("5432")+`
+  SHARED: `+encode("foo")+`
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: default-ns
+type: Opaque
+`)
+
+	result = th.LoadAndRunGenerator(config("file://"+filepath.Join(dir, "fixtures.yaml"), "  - FOO=FOO"))
+	if yamlResult, _ := result.AsYaml(); !strings.Contains(string(yamlResult), "FOO: "+encode("foo")+"\n") {
+		t.Errorf("Expected the value from the fixtures file, got %s", yamlResult)
+	}
+	result = th.LoadAndRunGenerator(config("file://"+filepath.Join(dir, "fixtures.yaml")+"#my-vault", "  - FOO=FOO\n  - BAR=BAR"))
+	if yamlResult, _ := result.AsYaml(); !strings.Contains(string(yamlResult), "FOO: "+encode("foo from my-vault")+"\n") || !strings.Contains(string(yamlResult), "BAR: "+encode("bar latest")+"\n") {
+		t.Errorf("Expected the values from the my-vault section and then the top level secrets, got %s", yamlResult)
+	}
+
+	os.Setenv("AZURE_SECRETS_FIXTURES", dir)
+	defer os.Unsetenv("AZURE_SECRETS_FIXTURES")
+	tests := map[string]string{
+		"  - KEY=MISSING":  "Secret 'MISSING' was not found in vault 'my-vault' in the fixtures " + dir,
+		"  - KEY=BAR@v3":   "Secret 'BAR@v3' was not found in vault 'my-vault' in the fixtures " + dir,
+		"  - KEY=DISABLED": "Version 'fixture' of secret 'DISABLED' from vault 'my-vault' is disabled",
+	}
+	for keys, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, config("my-vault", keys))
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' for %s, got %v", expected, keys, err)
+		}
+	}
+	err = errorFromLoadAndRunGenerator(th, config("file://"+filepath.Join(dir, "missing.yaml"), "  - KEY=FOO"))
+	if !strings.Contains(err.Error(), "Error reading fixtures") {
+		t.Errorf("Expected a missing fixtures error, got %v", err)
+	}
+}
+
+func TestAzureSecrets_Cassette(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fixtures := filepath.Join(dir, "fixtures.yaml")
+	err := ioutil.WriteFile(fixtures, []byte(`secrets:
+  FOO: foo
+  JSON: '{"user": "admin", "ports": [80, 443]}'
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cassettePath := filepath.Join(dir, "cassette.yaml")
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	config := func(values string, keys string) string {
+		return testConfig("vault: file://"+fixtures+"\ncassette: "+cassettePath+"\ncassetteValues: "+values, keys)
+	}
+	keys := `  - FOO=FOO
+  - USER=JSON#$.user
+  - FALLBACK=MISSING??FOO`
+	expected := `apiVersion: v1
+data:
+  FALLBACK: ` + encode("foo") + `
+  FOO: ` + encode("foo") + `
+  USER: ` + encode("admin") + `
+kind: Secret
+metadata:
+  name: test-secret
+  namespace: default-ns
+type: Opaque
+`
+
+	os.Setenv("AZURE_SECRETS_CASSETTE_MODE", "record")
+	th.AssertActualEqualsExpected(th.LoadAndRunGenerator(config("plain", keys)), expected)
+	os.Unsetenv("AZURE_SECRETS_CASSETTE_MODE")
+	if info, err := os.Stat(cassettePath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected a cassette with mode 0600, got %v %v", info, err)
+	}
+	os.Remove(fixtures)
+	th.AssertActualEqualsExpected(th.LoadAndRunGenerator(config("plain", keys)), expected)
+
+	err = errorFromLoadAndRunGenerator(th, config("plain", "  - BAR=BAR"))
+	if !strings.Contains(err.Error(), "Secret 'BAR' from vault 'file://"+fixtures+"' is not in the cassette "+cassettePath) {
+		t.Errorf("Expected an error for a secret that was not recorded, got %s", err)
+	}
+
+	err = ioutil.WriteFile(fixtures, []byte(`secrets:
+  FOO: foo
+  JSON: '{"user": "admin", "ports": [80, 443]}'
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(cassettePath)
+	os.Setenv("AZURE_SECRETS_CASSETTE_MODE", "record")
+	th.LoadAndRunGenerator(config("redacted", keys))
+	os.Unsetenv("AZURE_SECRETS_CASSETTE_MODE")
+	data, err := ioutil.ReadFile(cassettePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "foo") || strings.Contains(string(data), "admin") {
+		t.Errorf("Expected values to be redacted, got %s", data)
+	}
+	if !strings.Contains(string(data), `'{"ports":["REDACTED","REDACTED"],"user":"REDACTED"}'`) {
+		t.Errorf("Expected redacted JSON to keep its shape, got %s", data)
+	}
+	if !strings.Contains(string(data), "notFound: true") {
+		t.Errorf("Expected the missing secret to be recorded, got %s", data)
+	}
+	result := th.LoadAndRunGenerator(config("redacted", keys))
+	if yamlResult, _ := result.AsYaml(); !strings.Contains(string(yamlResult), "USER: "+encode("REDACTED")+"\n") {
+		t.Errorf("Expected redacted values to be replayed, got %s", yamlResult)
+	}
+
+	os.Remove(cassettePath)
+	os.Setenv("AZURE_SECRETS_CASSETTE_MODE", "record")
+	err = errorFromLoadAndRunGenerator(th, config("encrypted", keys))
+	if !strings.Contains(err.Error(), "Recording encrypted values requires AZURE_SECRETS_CASSETTE_KEY to be set") {
+		t.Errorf("Expected an error without a key, got %s", err)
+	}
+	os.Setenv("AZURE_SECRETS_CASSETTE_KEY", "passphrase")
+	th.LoadAndRunGenerator(config("encrypted", keys))
+	os.Unsetenv("AZURE_SECRETS_CASSETTE_MODE")
+	data, err = ioutil.ReadFile(cassettePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "foo") || strings.Contains(string(data), "admin") {
+		t.Errorf("Expected values to be encrypted, got %s", data)
+	}
+	os.Remove(fixtures)
+	th.AssertActualEqualsExpected(th.LoadAndRunGenerator(config("encrypted", keys)), expected)
+	os.Setenv("AZURE_SECRETS_CASSETTE_KEY", "wrong")
+	err = errorFromLoadAndRunGenerator(th, config("encrypted", keys))
+	os.Unsetenv("AZURE_SECRETS_CASSETTE_KEY")
+	if !strings.Contains(err.Error(), "Encrypted value could not be decrypted, check AZURE_SECRETS_CASSETTE_KEY") {
+		t.Errorf("Expected an error with the wrong key, got %s", err)
+	}
+
+	err = errorFromLoadAndRunGenerator(th, config("foo", keys))
+	if !strings.Contains(err.Error(), "Invalid cassetteValues 'foo'") {
+		t.Errorf("Expected an error for invalid cassetteValues, got %s", err)
+	}
+}
+
+func TestAzureSecrets_ForbidOffline(t *testing.T) {
+	os.Setenv("AZURE_SECRETS_OFFLINE_TESTING_MODE", "1")
+	defer os.Unsetenv("AZURE_SECRETS_OFFLINE_TESTING_MODE")
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	config := `apiVersion: devjoes/v1
+kind: AzureSecrets
+metadata:
+  name: default-name
+  namespace: default-ns
+vault: my-vault
+forbidOfflineFor: %s
+secrets:
+- name: dev-secret
+  namespace: dev
+  keys:
+  - FOO=FOO
+- name: prod-secret
+  namespace: prod
+  labels:
+    env: production
+  keys:
+  - FOO=FOO`
+
+	tests := map[string]string{
+		"[prod]":                     "Secret 'prod-secret' in namespace 'prod' must be read from a real vault because it matches forbidOfflineFor 'prod', but vault 'my-vault' is offline",
+		"['env=production']":         "Secret 'prod-secret' in namespace 'prod' must be read from a real vault because it matches forbidOfflineFor 'env=production'",
+		"['env in (production, x)']": "because it matches forbidOfflineFor 'env in (production, x)'",
+		"['env in (prod']":           "Invalid forbidOfflineFor 'env in (prod'",
+		"['Not A Namespace']":        "Invalid forbidOfflineFor 'Not A Namespace'",
+	}
+	for forbid, expected := range tests {
+		err := errorFromLoadAndRunGenerator(th, fmt.Sprintf(config, forbid))
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' for %s, got %s", expected, forbid, err)
+		}
+	}
+
+	th.LoadAndRunGenerator(fmt.Sprintf(config, "[staging, 'env=staging']"))
+
+	os.Setenv("AZURE_SECRETS_ENVIRONMENT", "prod")
+	err := errorFromLoadAndRunGenerator(th, fmt.Sprintf(config, "[]"))
+	os.Unsetenv("AZURE_SECRETS_ENVIRONMENT")
+	if !strings.Contains(err.Error(), "Secret 'dev-secret' in namespace 'dev' must be read from a real vault because AZURE_SECRETS_ENVIRONMENT is 'prod'") {
+		t.Errorf("Expected offline secrets to be refused in production, got %s", err)
+	}
+}
+
+func TestAzureSecrets_Strict(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("devjoes", "v1", "AzureSecrets")
+	config := func(strict bool, onError string, keys string) string {
+		return testConfig(fmt.Sprintf("vault: __TESTING_AZURESECRETS__\nstrict: %t\ncacheFile: %s\nonError:\n  warn: true\n  %s", strict, filepath.Join(dir, "cache.yaml"), onError), keys)
+	}
+
+	yamlResult, _ := th.LoadAndRunGenerator(config(false, "placeholder:\n    strategy: sentinel\n    value: CHANGEME", "  - K=ERR")).AsYaml()
+	if !strings.Contains(string(yamlResult), "K: "+encode("CHANGEME")) {
+		t.Errorf("Expected a placeholder when not strict, got %s", yamlResult)
+	}
+	for _, placeholder := range []string{"random", "sentinel\n    value: CHANGEME", "previous"} {
+		err := errorFromLoadAndRunGenerator(th, config(true, "placeholder:\n    strategy: "+placeholder, "  - K=ERR"))
+		if !strings.Contains(err.Error(), "secret 'test-secret' would be output with placeholders which is not allowed in strict mode") {
+			t.Errorf("Expected the %s placeholder strategy to be rejected in strict mode, got %s", placeholder, err)
+		}
+	}
+
+	// Excluded secrets and defaults that look like placeholders are fine
+	th.LoadAndRunGenerator(config(true, "exclude: true", "  - K=ERR"))
+	yamlResult, _ = th.LoadAndRunGenerator(config(true, "exclude: false", "  - K=MISSING1??'ERROR_ONLY'")).AsYaml()
+	if !strings.Contains(string(yamlResult), "K: "+encode("ERROR_ONLY")) {
+		t.Errorf("Expected the default value in strict mode, got %s", yamlResult)
+	}
+
+	os.Setenv("AZURE_SECRETS_ENVIRONMENT", "production")
+	err := errorFromLoadAndRunGenerator(th, config(false, "exclude: false", "  - K=ERR"))
+	os.Unsetenv("AZURE_SECRETS_ENVIRONMENT")
+	if !strings.Contains(err.Error(), "must be read from a real vault because AZURE_SECRETS_ENVIRONMENT is 'production'") {
+		t.Errorf("Expected the test vault to be refused in production, got %s", err)
+	}
+}
@@ -5,11 +5,14 @@ go 1.12
 require (
 	github.com/Azure/azure-sdk-for-go v39.0.0+incompatible
 	github.com/Azure/go-autorest/autorest v0.9.0
-	github.com/Azure/go-autorest/autorest/azure/auth v0.4.2 // indirect
+	github.com/Azure/go-autorest/autorest/adal v0.6.0
+	github.com/Azure/go-autorest/autorest/azure/auth v0.4.2
 	github.com/Azure/go-autorest/autorest/to v0.3.0 // indirect
 	github.com/Azure/go-autorest/autorest/validation v0.2.0 // indirect
 	github.com/pkg/errors v0.8.1
+	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392
 	k8s.io/api v0.17.0
+	k8s.io/apimachinery v0.17.0
 	sigs.k8s.io/kustomize/api v0.3.2
 	sigs.k8s.io/yaml v1.1.0
 )